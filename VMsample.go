@@ -2,40 +2,202 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Azure-Samples/virtual-machines-go-manage/lro"
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
 	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
 	"github.com/Azure/azure-sdk-for-go/arm/storage"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
 )
 
+// msiEndpoint is the well-known endpoint the Azure Instance Metadata Service
+// exposes for acquiring a managed identity token.
+const msiEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
 var (
 	resourceGroupName = "VMsampleResourceGroup"
 	accountName       = "mystorageaccount"
 	location          = "westus"
 	vhdURItemplate    = "https://%s.blob.core.windows.net/golangcontainer/%s.vhd"
 
+	// sshPublicKeyPath is the path authorized_keys is written to on Linux VMs.
+	sshPublicKeyPath = "/home/notadmin/.ssh/authorized_keys"
+
 	groupClient      resources.GroupsClient
 	accountClient    storage.AccountsClient
 	vNetClient       network.VirtualNetworksClient
 	subnetClient     network.SubnetsClient
 	addressClient    network.PublicIPAddressesClient
 	interfacesClient network.InterfacesClient
+	nsgClient        network.SecurityGroupsClient
+	lbClient         network.LoadBalancersClient
 	vmClient         compute.VirtualMachinesClient
+	disksClient      compute.DisksClient
+	snapshotsClient  compute.SnapshotsClient
+	vmssClient       compute.VirtualMachineScaleSetsClient
+	vmssVMsClient    compute.VirtualMachineScaleSetVMsClient
+
+	// subscriptionID is stashed at setup time so later code can build resource IDs.
+	subscriptionID string
+
+	// vmssName names the scale set created when vmMode is "scaleSet".
+	vmssName = "vmss"
+
+	// vmMode picks between provisioning two singleton VMs ("singleVM", the default)
+	// or a VM Scale Set ("scaleSet"), controlled by the AZURE_VM_MODE environment variable.
+	vmMode = getVMMode()
+
+	// vmssCapacity is the initial instance count of the scale set, controlled by the
+	// AZURE_VMSS_CAPACITY environment variable.
+	vmssCapacity = getVMSSCapacity()
+
+	// useManagedDisks selects Azure Managed Disks over the unmanaged VHD-on-page-blob
+	// model, controlled by the AZURE_USE_MANAGED_DISKS environment variable.
+	useManagedDisks = os.Getenv("AZURE_USE_MANAGED_DISKS") == "1"
+
+	// diskStorageAccountType is the managed disk SKU used when useManagedDisks is set,
+	// controlled by the AZURE_DISK_SKU environment variable.
+	diskStorageAccountType = getDiskStorageAccountType()
+
+	// nsgSourceAddressPrefix restricts inbound NSG rules to this CIDR or address,
+	// controlled by the AZURE_NSG_SOURCE_ADDRESS_PREFIX environment variable.
+	nsgSourceAddressPrefix = getNSGSourceAddressPrefix()
+
+	// nsgRulePriority is the priority given to the generated inbound NSG rules,
+	// controlled by the AZURE_NSG_RULE_PRIORITY environment variable.
+	nsgRulePriority = getNSGRulePriority()
 )
 
+// getNSGSourceAddressPrefix returns the configured source address prefix for inbound
+// NSG rules, defaulting to "*" (open to the world) when unset.
+func getNSGSourceAddressPrefix() string {
+	if prefix := os.Getenv("AZURE_NSG_SOURCE_ADDRESS_PREFIX"); prefix != "" {
+		return prefix
+	}
+	return "*"
+}
+
+// getNSGRulePriority returns the configured priority for inbound NSG rules,
+// defaulting to 100 when unset or invalid.
+func getNSGRulePriority() int32 {
+	if value := os.Getenv("AZURE_NSG_RULE_PRIORITY"); value != "" {
+		if priority, err := strconv.Atoi(value); err == nil {
+			return int32(priority)
+		}
+	}
+	return 100
+}
+
+// getVMMode returns "scaleSet" when AZURE_VM_MODE requests a VM Scale Set, and
+// "singleVM" (the original two-VM demo) otherwise.
+func getVMMode() string {
+	if os.Getenv("AZURE_VM_MODE") == "scaleSet" {
+		return "scaleSet"
+	}
+	return "singleVM"
+}
+
+// getVMSSCapacity returns the configured scale set capacity from AZURE_VMSS_CAPACITY,
+// defaulting to 2 when unset or invalid.
+func getVMSSCapacity() int64 {
+	if value := os.Getenv("AZURE_VMSS_CAPACITY"); value != "" {
+		if capacity, err := strconv.Atoi(value); err == nil && capacity > 0 {
+			return int64(capacity)
+		}
+	}
+	return 2
+}
+
+// getDiskStorageAccountType maps the AZURE_DISK_SKU environment variable to a managed
+// disk storage account type, defaulting to Premium_LRS.
+func getDiskStorageAccountType() compute.DiskStorageAccountTypes {
+	switch os.Getenv("AZURE_DISK_SKU") {
+	case "Standard_LRS":
+		return compute.StandardLRS
+	case "StandardSSD_LRS":
+		return compute.StandardSSDLRS
+	default:
+		return compute.PremiumLRS
+	}
+}
+
+// getLROTimeout returns the configured timeout for long-running operations from
+// AZURE_LRO_TIMEOUT_MINUTES, defaulting to 30 minutes when unset or invalid.
+func getLROTimeout() time.Duration {
+	if value := os.Getenv("AZURE_LRO_TIMEOUT_MINUTES"); value != "" {
+		if minutes, err := strconv.Atoi(value); err == nil && minutes > 0 {
+			return time.Duration(minutes) * time.Minute
+		}
+	}
+	return 30 * time.Minute
+}
+
+// lroProgress receives a Progress event from runLRO every time a long-running
+// operation completes; main logs these as they arrive.
+var lroProgress = make(chan lro.Progress)
+
+// lroTimeout bounds how long runLRO waits for a single long-running operation.
+var lroTimeout = getLROTimeout()
+
+// runLRO runs fn, a single long-running SDK call such as
+// client.CreateOrUpdate(..., cancel), under a context that is canceled after
+// lroTimeout, reporting its outcome on lroProgress and returning a *lro.Error
+// if it failed, timed out, or was canceled.
+func runLRO(resource, operation string, fn func(cancel <-chan struct{}) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), lroTimeout)
+	defer cancel()
+	return lro.Run(ctx, resource, operation, lroProgress, fn)
+}
+
+// linuxPublishers lists the image publishers this sample treats as Linux for
+// the purpose of choosing an OsProfile (SSH keys) over a Windows one (password).
+var linuxPublishers = []string{"Canonical", "CoreOS", "OpenLogic", "RedHat", "SUSE"}
+
+// isLinuxPublisher reports whether publisher identifies a Linux image.
+func isLinuxPublisher(publisher string) bool {
+	for _, p := range linuxPublishers {
+		if strings.EqualFold(p, publisher) {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
+	go func() {
+		for p := range lroProgress {
+			fmt.Printf("\t...%s %s finished in %s\n", p.Operation, p.Resource, p.Elapsed.Round(time.Second))
+		}
+	}()
+
 	subnetInfo, err := setup()
 	if err != nil {
 		printError(err)
 		return
 	}
 
+	if vmMode == "scaleSet" {
+		if err := runScaleSet(subnetInfo); err != nil {
+			printError(err)
+		}
+		return
+	}
+
 	linuxVMname, windowsVMname := "linuxVM", "windowsVM"
 
 	if err := createVM(linuxVMname, "Canonical", "UbuntuServer", "16.04.0-LTS", subnetInfo); err != nil {
@@ -81,35 +243,59 @@ func main() {
 
 // setup performs all needed operations before creating a VM, including getting credentials, setting up clients and creating resources.
 func setup() (*network.Subnet, error) {
-	credentials, err := getCredentials()
+	subscriptionID = os.Getenv("AZURE_SUBSCRIPTION_ID")
+	if subscriptionID == "" {
+		return nil, fmt.Errorf("Missing environment variable AZURE_SUBSCRIPTION_ID")
+	}
+
+	env, err := getEnvironment()
 	if err != nil {
 		return nil, err
 	}
-	token, err := getToken(credentials)
+
+	authorizer, err := getAuthorizer(env)
 	if err != nil {
 		return nil, err
 	}
 
-	groupClient = resources.NewGroupsClient(credentials["AZURE_SUBSCRIPTION_ID"])
-	groupClient.Authorizer = token
+	groupClient = resources.NewGroupsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	groupClient.Authorizer = authorizer
 
-	accountClient = storage.NewAccountsClient(credentials["AZURE_SUBSCRIPTION_ID"])
-	accountClient.Authorizer = token
+	accountClient = storage.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	accountClient.Authorizer = authorizer
 
-	vNetClient = network.NewVirtualNetworksClient(credentials["AZURE_SUBSCRIPTION_ID"])
-	vNetClient.Authorizer = token
+	vNetClient = network.NewVirtualNetworksClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	vNetClient.Authorizer = authorizer
 
-	subnetClient = network.NewSubnetsClient(credentials["AZURE_SUBSCRIPTION_ID"])
-	subnetClient.Authorizer = token
+	subnetClient = network.NewSubnetsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	subnetClient.Authorizer = authorizer
 
-	addressClient = network.NewPublicIPAddressesClient(credentials["AZURE_SUBSCRIPTION_ID"])
-	addressClient.Authorizer = token
+	addressClient = network.NewPublicIPAddressesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	addressClient.Authorizer = authorizer
 
-	interfacesClient = network.NewInterfacesClient(credentials["AZURE_SUBSCRIPTION_ID"])
-	interfacesClient.Authorizer = token
+	interfacesClient = network.NewInterfacesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	interfacesClient.Authorizer = authorizer
 
-	vmClient = compute.NewVirtualMachinesClient(credentials["AZURE_SUBSCRIPTION_ID"])
-	vmClient.Authorizer = token
+	nsgClient = network.NewSecurityGroupsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	nsgClient.Authorizer = authorizer
+
+	lbClient = network.NewLoadBalancersClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	lbClient.Authorizer = authorizer
+
+	vmClient = compute.NewVirtualMachinesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	vmClient.Authorizer = authorizer
+
+	disksClient = compute.NewDisksClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	disksClient.Authorizer = authorizer
+
+	snapshotsClient = compute.NewSnapshotsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	snapshotsClient.Authorizer = authorizer
+
+	vmssClient = compute.NewVirtualMachineScaleSetsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	vmssClient.Authorizer = authorizer
+
+	vmssVMsClient = compute.NewVirtualMachineScaleSetVMsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	vmssVMsClient.Authorizer = authorizer
 
 	subnetInfo, err := createNeededResources()
 	if err != nil {
@@ -119,17 +305,123 @@ func setup() (*network.Subnet, error) {
 	return subnetInfo, nil
 }
 
-// getCredentials gets some credentials from your environment variables.
-func getCredentials() (map[string]string, error) {
+// getEnvironment resolves the Azure cloud environment to target, defaulting to
+// AzurePublicCloud. Set AZURE_ENVIRONMENT to AzureChinaCloud, AzureGermanCloud,
+// AzureUSGovernmentCloud, or the path to a custom environment JSON file.
+func getEnvironment() (azure.Environment, error) {
+	name := os.Getenv("AZURE_ENVIRONMENT")
+	if name == "" {
+		return azure.PublicCloud, nil
+	}
+	if _, err := os.Stat(name); err == nil {
+		return azure.EnvironmentFromFile(name)
+	}
+	return azure.EnvironmentFromName(name)
+}
+
+// getAuthorizer picks an authentication mode and returns the resulting authorizer.
+// The default is a service principal from environment variables; set AZURE_USE_MSI=1,
+// AZURE_USE_DEVICE_FLOW=1, or AZURE_USE_CLI_AUTH=1 to use one of the alternatives.
+func getAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	switch {
+	case os.Getenv("AZURE_USE_MSI") == "1":
+		return msiAuthorizer(env)
+	case os.Getenv("AZURE_USE_DEVICE_FLOW") == "1":
+		return deviceFlowAuthorizer(env)
+	case os.Getenv("AZURE_USE_CLI_AUTH") == "1":
+		return cliAuthorizer(env)
+	default:
+		return servicePrincipalAuthorizer(env)
+	}
+}
+
+// servicePrincipalAuthorizer authenticates with the service principal described by
+// the AZURE_CLIENT_ID, AZURE_CLIENT_SECRET and AZURE_TENANT_ID environment variables.
+func servicePrincipalAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
 	credentials := map[string]string{
-		"AZURE_CLIENT_ID":       os.Getenv("AZURE_CLIENT_ID"),
-		"AZURE_CLIENT_SECRET":   os.Getenv("AZURE_CLIENT_SECRET"),
-		"AZURE_SUBSCRIPTION_ID": os.Getenv("AZURE_SUBSCRIPTION_ID"),
-		"AZURE_TENANT_ID":       os.Getenv("AZURE_TENANT_ID")}
+		"AZURE_CLIENT_ID":     os.Getenv("AZURE_CLIENT_ID"),
+		"AZURE_CLIENT_SECRET": os.Getenv("AZURE_CLIENT_SECRET"),
+		"AZURE_TENANT_ID":     os.Getenv("AZURE_TENANT_ID")}
 	if err := checkEnvVar(&credentials); err != nil {
 		return nil, err
 	}
-	return credentials, nil
+
+	oauthConfig, err := env.OAuthConfigForTenant(credentials["AZURE_TENANT_ID"])
+	if err != nil {
+		return nil, err
+	}
+	return azure.NewServicePrincipalToken(*oauthConfig, credentials["AZURE_CLIENT_ID"], credentials["AZURE_CLIENT_SECRET"], env.ResourceManagerEndpoint)
+}
+
+// msiAuthorizer authenticates as the VM's system-assigned managed identity.
+func msiAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	return azure.NewServicePrincipalTokenFromMSI(msiEndpoint, env.ResourceManagerEndpoint)
+}
+
+// deviceFlowAuthorizer walks the user through an interactive device-code login,
+// using the AZURE_CLIENT_ID and AZURE_TENANT_ID environment variables.
+func deviceFlowAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	credentials := map[string]string{
+		"AZURE_CLIENT_ID": os.Getenv("AZURE_CLIENT_ID"),
+		"AZURE_TENANT_ID": os.Getenv("AZURE_TENANT_ID")}
+	if err := checkEnvVar(&credentials); err != nil {
+		return nil, err
+	}
+
+	deviceConfig := azure.NewDeviceFlowConfig(credentials["AZURE_CLIENT_ID"], credentials["AZURE_TENANT_ID"])
+	deviceConfig.AADEndpoint = env.ActiveDirectoryEndpoint
+	deviceConfig.Resource = env.ResourceManagerEndpoint
+	return deviceConfig.Authorize()
+}
+
+// cliAuthorizer authenticates using a token cached by the Azure CLI ('az login'),
+// read from the current user's ~/.azure profile.
+func cliAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	accessToken, err := cliAccessToken(env)
+	if err != nil {
+		return nil, err
+	}
+	return autorest.NewBearerAuthorizer(staticTokenProvider{accessToken}), nil
+}
+
+// cliAccessToken reads the access token cached for env's resource manager endpoint
+// from the Azure CLI's ~/.azure/accessTokens.json.
+func cliAccessToken(env azure.Environment) (string, error) {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = os.Getenv("USERPROFILE")
+	}
+	path := filepath.Join(homeDir, ".azure", "accessTokens.json")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read az CLI token cache %q: %s", path, err)
+	}
+
+	var cachedTokens []struct {
+		AccessToken string `json:"accessToken"`
+		Resource    string `json:"resource"`
+	}
+	if err := json.Unmarshal(data, &cachedTokens); err != nil {
+		return "", fmt.Errorf("failed to parse az CLI token cache %q: %s", path, err)
+	}
+
+	resource := strings.TrimSuffix(env.ResourceManagerEndpoint, "/")
+	for _, cached := range cachedTokens {
+		if strings.TrimSuffix(cached.Resource, "/") == resource {
+			return cached.AccessToken, nil
+		}
+	}
+	return "", fmt.Errorf("no cached az CLI token for %q found, run 'az login' first", resource)
+}
+
+// staticTokenProvider adapts a fixed bearer token to autorest.TokenProvider.
+type staticTokenProvider struct {
+	token string
+}
+
+func (s staticTokenProvider) OAuthToken() string {
+	return s.token
 }
 
 // checkEnvVar checks if the environment variables are actually set.
@@ -146,27 +438,26 @@ func checkEnvVar(envVars *map[string]string) error {
 	return nil
 }
 
-// getToken gets a token using your credentials. The token will be used by clients.
-func getToken(credentials map[string]string) (*azure.ServicePrincipalToken, error) {
-	oauthConfig, err := azure.PublicCloud.OAuthConfigForTenant(credentials["AZURE_TENANT_ID"])
-	if err != nil {
-		return nil, err
-	}
-	token, err := azure.NewServicePrincipalToken(*oauthConfig, credentials["AZURE_CLIENT_ID"], credentials["AZURE_CLIENT_SECRET"], azure.PublicCloud.ResourceManagerEndpoint)
-	if err != nil {
-		return nil, err
-	}
-	return token, nil
-}
-
-// createNeededResources creates all common resources needed before creating VMs.
+// createNeededResources creates all common resources needed before creating VMs,
+// reusing any that already exist so the sample is safe to re-run.
 func createNeededResources() (*network.Subnet, error) {
 	fmt.Println("Create resource group...")
-	resourceGroupParameters := resources.ResourceGroup{
-		Location: &location}
-	if _, err := groupClient.CreateOrUpdate(resourceGroupName, resourceGroupParameters); err != nil {
+	if _, err := groupClient.Get(resourceGroupName); err == nil {
+		fmt.Printf("\tResource group '%s' already exists, reusing it\n", resourceGroupName)
+	} else {
+		resourceGroupParameters := resources.ResourceGroup{
+			Location: &location}
+		if _, err := groupClient.CreateOrUpdate(resourceGroupName, resourceGroupParameters); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Check storage account name availability...")
+	availableAccountName, err := ensureAvailableStorageAccountName(accountName)
+	if err != nil {
 		return nil, err
 	}
+	accountName = availableAccountName
 
 	fmt.Println("Create storage account...")
 	accountParameters := storage.AccountCreateParameters{
@@ -174,28 +465,45 @@ func createNeededResources() (*network.Subnet, error) {
 			Name: storage.StandardLRS},
 		Location:   &location,
 		Properties: &storage.AccountPropertiesCreateParameters{}}
-	if _, err := accountClient.Create(resourceGroupName, accountName, accountParameters, nil); err != nil {
+	if err := runLRO(accountName, "Create", func(cancel <-chan struct{}) error {
+		_, err := accountClient.Create(resourceGroupName, accountName, accountParameters, cancel)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
 	fmt.Println("Create virtual network...")
 	vNetName := "vNet"
-	vNetParameters := network.VirtualNetwork{
-		Location: &location,
-		Properties: &network.VirtualNetworkPropertiesFormat{
-			AddressSpace: &network.AddressSpace{
-				AddressPrefixes: &[]string{"10.0.0.0/16"}}}}
-	if _, err := vNetClient.CreateOrUpdate(resourceGroupName, vNetName, vNetParameters, nil); err != nil {
-		return nil, err
+	if _, err := vNetClient.Get(resourceGroupName, vNetName, ""); err == nil {
+		fmt.Printf("\tVirtual network '%s' already exists, reusing it\n", vNetName)
+	} else {
+		vNetParameters := network.VirtualNetwork{
+			Location: &location,
+			Properties: &network.VirtualNetworkPropertiesFormat{
+				AddressSpace: &network.AddressSpace{
+					AddressPrefixes: &[]string{"10.0.0.0/16"}}}}
+		if err := runLRO(vNetName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+			_, err := vNetClient.CreateOrUpdate(resourceGroupName, vNetName, vNetParameters, cancel)
+			return err
+		}); err != nil {
+			return nil, err
+		}
 	}
 
 	fmt.Println("Create subnet...")
 	subnetName := "subnet"
-	subnet := network.Subnet{
-		Properties: &network.SubnetPropertiesFormat{
-			AddressPrefix: to.StringPtr("10.0.0.0/24")}}
-	if _, err := subnetClient.CreateOrUpdate(resourceGroupName, vNetName, subnetName, subnet, nil); err != nil {
-		return nil, err
+	if _, err := subnetClient.Get(resourceGroupName, vNetName, subnetName, ""); err == nil {
+		fmt.Printf("\tSubnet '%s' already exists, reusing it\n", subnetName)
+	} else {
+		subnet := network.Subnet{
+			Properties: &network.SubnetPropertiesFormat{
+				AddressPrefix: to.StringPtr("10.0.0.0/24")}}
+		if err := runLRO(subnetName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+			_, err := subnetClient.CreateOrUpdate(resourceGroupName, vNetName, subnetName, subnet, cancel)
+			return err
+		}); err != nil {
+			return nil, err
+		}
 	}
 
 	fmt.Println("Get subnet info...")
@@ -207,24 +515,74 @@ func createNeededResources() (*network.Subnet, error) {
 	return &subnetInfo, err
 }
 
+// ensureAvailableStorageAccountName checks name for availability and, if it is
+// already taken, appends random lowercase alphanumeric suffixes until an available
+// one is found, giving up with an error after 10 attempts.
+func ensureAvailableStorageAccountName(name string) (string, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		result, err := accountClient.CheckNameAvailability(storage.AccountCheckNameAvailabilityParameters{
+			Name: &name,
+			Type: to.StringPtr("Microsoft.Storage/storageAccounts")})
+		if err != nil {
+			return "", err
+		}
+		if result.NameAvailable == nil || *result.NameAvailable {
+			return name, nil
+		}
+
+		reason := "unknown reason"
+		if result.Message != nil {
+			reason = *result.Message
+		}
+		fmt.Printf("\tStorage account name '%s' is unavailable (%s), trying another one...\n", name, reason)
+		name = fmt.Sprintf("%s%s", accountName, randomLowerAlphaNumeric(6))
+	}
+	return "", fmt.Errorf("could not find an available storage account name derived from %q", accountName)
+}
+
+var nameRand = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+
+// randomLowerAlphaNumeric returns a random lowercase alphanumeric string of length n.
+func randomLowerAlphaNumeric(n int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	suffix := make([]byte, n)
+	for i := range suffix {
+		suffix[i] = alphabet[nameRand.Intn(len(alphabet))]
+	}
+	return string(suffix)
+}
+
 // createVM creates a VM in the provided subnet.
 func createVM(vmName, publisher, offer, sku string, subnetInfo *network.Subnet) error {
-	publicIPaddress, nicParameters, err := createPIPandNIC(vmName, subnetInfo)
+	publicIPaddress, nicParameters, err := createPIPandNIC(vmName, isLinuxPublisher(publisher), subnetInfo)
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("Create '%s' VM...\n", vmName)
-	vm := setVMparameters(vmName, publisher, offer, sku, *nicParameters.ID)
-	if _, err := vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, nil); err != nil {
+	vm, err := setVMparameters(vmName, publisher, offer, sku, *nicParameters.ID)
+	if err != nil {
+		return err
+	}
+	if err := runLRO(vmName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, cancel)
+		return err
+	}); err != nil {
 		return err
 	}
 
-	fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' with password '%s'\n",
-		vmName,
-		*vm.Properties.OsProfile.AdminUsername,
-		*publicIPaddress.Properties.DNSSettings.Fqdn,
-		*vm.Properties.OsProfile.AdminPassword)
+	if isLinuxPublisher(publisher) {
+		fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' using your SSH key\n",
+			vmName,
+			*vm.Properties.OsProfile.AdminUsername,
+			*publicIPaddress.Properties.DNSSettings.Fqdn)
+	} else {
+		fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' with password '%s'\n",
+			vmName,
+			*vm.Properties.OsProfile.AdminUsername,
+			*publicIPaddress.Properties.DNSSettings.Fqdn,
+			*vm.Properties.OsProfile.AdminPassword)
+	}
 
 	return nil
 }
@@ -242,56 +600,166 @@ func vmOperations(vmName string) error {
 	vm.Tags = &(map[string]*string{
 		"who rocks": to.StringPtr("golang"),
 		"where":     to.StringPtr("on azure")})
-	_, err = vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, nil)
+	err = runLRO(vmName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, cancel)
+		return err
+	})
 	printError(err)
 
 	fmt.Println("Attach data disk...")
-	vm.Properties.StorageProfile.DataDisks = &[]compute.DataDisk{{
-		Lun:  to.Int32Ptr(0),
-		Name: to.StringPtr("dataDisk"),
-		Vhd: &compute.VirtualHardDisk{
-			URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, fmt.Sprintf("dataDisks-%v", vmName)))},
-		CreateOption: compute.Empty,
-		DiskSizeGB:   to.Int32Ptr(1)}}
-	_, err = vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, nil)
+	dataDisk, err := setDataDisk(vmName)
+	printError(err)
+	vm.Properties.StorageProfile.DataDisks = &[]compute.DataDisk{*dataDisk}
+	err = runLRO(vmName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, cancel)
+		return err
+	})
 	printError(err)
 
 	fmt.Println("Detach data disks...")
 	vm.Properties.StorageProfile.DataDisks = &[]compute.DataDisk{}
-	_, err = vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, nil)
+	err = runLRO(vmName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, cancel)
+		return err
+	})
 	printError(err)
 
 	fmt.Println("Update OS disk size...")
-	if vm.Properties.StorageProfile.OsDisk.DiskSizeGB == nil {
-		vm.Properties.StorageProfile.OsDisk.DiskSizeGB = to.Int32Ptr(0)
-	}
-	_, err = vmClient.Deallocate(resourceGroupName, vmName, nil)
+	err = runLRO(vmName, "Deallocate", func(cancel <-chan struct{}) error {
+		_, err := vmClient.Deallocate(resourceGroupName, vmName, cancel)
+		return err
+	})
 	printError(err)
-	if *vm.Properties.StorageProfile.OsDisk.DiskSizeGB <= 0 {
-		*vm.Properties.StorageProfile.OsDisk.DiskSizeGB = 256
+	if useManagedDisks {
+		printError(resizeManagedOSDisk(vmName, &vm))
+	} else {
+		if vm.Properties.StorageProfile.OsDisk.DiskSizeGB == nil {
+			vm.Properties.StorageProfile.OsDisk.DiskSizeGB = to.Int32Ptr(0)
+		}
+		if *vm.Properties.StorageProfile.OsDisk.DiskSizeGB <= 0 {
+			*vm.Properties.StorageProfile.OsDisk.DiskSizeGB = 256
+		}
+		*vm.Properties.StorageProfile.OsDisk.DiskSizeGB += 10
+		err = runLRO(vmName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+			_, err := vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, cancel)
+			return err
+		})
+		printError(err)
+	}
+
+	if useManagedDisks {
+		fmt.Println("Snapshot OS disk...")
+		printError(snapshotOSDisk(vmName, &vm))
 	}
-	*vm.Properties.StorageProfile.OsDisk.DiskSizeGB += 10
-	_, err = vmClient.CreateOrUpdate(resourceGroupName, vmName, vm, nil)
-	printError(err)
 
 	fmt.Println("Start VM...")
-	_, err = vmClient.Start(resourceGroupName, vmName, nil)
-	printError(err)
+	printError(runLRO(vmName, "Start", func(cancel <-chan struct{}) error {
+		_, err := vmClient.Start(resourceGroupName, vmName, cancel)
+		return err
+	}))
 
 	fmt.Println("Restart VM...")
-	_, err = vmClient.Restart(resourceGroupName, vmName, nil)
-	printError(err)
+	printError(runLRO(vmName, "Restart", func(cancel <-chan struct{}) error {
+		_, err := vmClient.Restart(resourceGroupName, vmName, cancel)
+		return err
+	}))
 
 	fmt.Println("Stop VM...")
-	_, err = vmClient.PowerOff(resourceGroupName, vmName, nil)
-	printError(err)
+	printError(runLRO(vmName, "PowerOff", func(cancel <-chan struct{}) error {
+		_, err := vmClient.PowerOff(resourceGroupName, vmName, cancel)
+		return err
+	}))
 
 	return nil
 }
 
-// createPIPandNIC creates a public IP address and a network interface in an existing subnet.
+// setDataDisk builds the data disk to attach to vmName, creating an Azure Managed Disk
+// via disksClient when useManagedDisks is set or an unmanaged VHD otherwise.
+func setDataDisk(vmName string) (*compute.DataDisk, error) {
+	if !useManagedDisks {
+		return &compute.DataDisk{
+			Lun:  to.Int32Ptr(0),
+			Name: to.StringPtr("dataDisk"),
+			Vhd: &compute.VirtualHardDisk{
+				URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, fmt.Sprintf("dataDisks-%v", vmName)))},
+			CreateOption: compute.Empty,
+			DiskSizeGB:   to.Int32Ptr(1)}, nil
+	}
+
+	diskName := fmt.Sprintf("%s-datadisk", vmName)
+	diskParameters := compute.Disk{
+		Location: &location,
+		Properties: &compute.DiskProperties{
+			CreationData: &compute.CreationData{
+				CreateOption: compute.Empty},
+			AccountType: diskStorageAccountType,
+			DiskSizeGB:  to.Int32Ptr(1)}}
+	if err := runLRO(diskName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := disksClient.CreateOrUpdate(resourceGroupName, diskName, diskParameters, cancel)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	disk, err := disksClient.Get(resourceGroupName, diskName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compute.DataDisk{
+		Lun:          to.Int32Ptr(0),
+		Name:         &diskName,
+		ManagedDisk:  &compute.ManagedDiskParameters{ID: disk.ID},
+		CreateOption: compute.Attach,
+		DiskSizeGB:   disk.Properties.DiskSizeGB}, nil
+}
+
+// resizeManagedOSDisk grows the managed OS disk backing vmName by patching the Disk
+// resource directly. The VM must already be deallocated.
+func resizeManagedOSDisk(vmName string, vm *compute.VirtualMachine) error {
+	diskName := resourceNameFromID(*vm.Properties.StorageProfile.OsDisk.ManagedDisk.ID)
+	disk, err := disksClient.Get(resourceGroupName, diskName)
+	if err != nil {
+		return err
+	}
+	if disk.Properties.DiskSizeGB == nil || *disk.Properties.DiskSizeGB <= 0 {
+		disk.Properties.DiskSizeGB = to.Int32Ptr(256)
+	}
+	*disk.Properties.DiskSizeGB += 10
+	return runLRO(diskName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := disksClient.CreateOrUpdate(resourceGroupName, diskName, disk, cancel)
+		return err
+	})
+}
+
+// snapshotOSDisk creates a point-in-time snapshot of the managed OS disk backing vmName.
+func snapshotOSDisk(vmName string, vm *compute.VirtualMachine) error {
+	snapshotName := fmt.Sprintf("%s-osdisk-snapshot", vmName)
+	snapshotParameters := compute.Snapshot{
+		Location: &location,
+		Properties: &compute.SnapshotProperties{
+			CreationData: &compute.CreationData{
+				CreateOption:     compute.Copy,
+				SourceResourceID: vm.Properties.StorageProfile.OsDisk.ManagedDisk.ID}}}
+	if err := runLRO(snapshotName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := snapshotsClient.CreateOrUpdate(resourceGroupName, snapshotName, snapshotParameters, cancel)
+		return err
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("\tCreated snapshot '%s'\n", snapshotName)
+	return nil
+}
+
+// resourceNameFromID returns the last segment of an Azure resource ID.
+func resourceNameFromID(id string) string {
+	parts := strings.Split(id, "/")
+	return parts[len(parts)-1]
+}
+
+// createPIPandNIC creates a public IP address, a network security group locking down
+// the VM to its OS's management port, and a network interface in an existing subnet.
 // It returns a network interface ready to be used to create a virtual machine.
-func createPIPandNIC(machine string, subnetInfo *network.Subnet) (*network.PublicIPAddress, *network.Interface, error) {
+func createPIPandNIC(machine string, isLinux bool, subnetInfo *network.Subnet) (*network.PublicIPAddress, *network.Interface, error) {
 	fmt.Printf("Create PIP and NIC for %s VM...\n", machine)
 	fmt.Println("\tCreate public IP address...")
 	IPname := fmt.Sprintf("pip-%s", machine)
@@ -300,7 +768,10 @@ func createPIPandNIC(machine string, subnetInfo *network.Subnet) (*network.Publi
 		Properties: &network.PublicIPAddressPropertiesFormat{
 			DNSSettings: &network.PublicIPAddressDNSSettings{
 				DomainNameLabel: to.StringPtr(fmt.Sprintf("azuresample-%s", strings.ToLower(machine[:5])))}}}
-	if _, err := addressClient.CreateOrUpdate(resourceGroupName, IPname, pipParameters, nil); err != nil {
+	if err := runLRO(IPname, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := addressClient.CreateOrUpdate(resourceGroupName, IPname, pipParameters, cancel)
+		return err
+	}); err != nil {
 		return nil, nil, err
 	}
 
@@ -310,6 +781,12 @@ func createPIPandNIC(machine string, subnetInfo *network.Subnet) (*network.Publi
 		return nil, nil, err
 	}
 
+	fmt.Println("\tCreate network security group...")
+	nsg, err := createNSG(machine, isLinux)
+	if err != nil {
+		return &publicIPaddress, nil, err
+	}
+
 	fmt.Println("\tCreate NIC...")
 	nicName := fmt.Sprintf("nic-%s", machine)
 	nicParameters := network.Interface{
@@ -320,8 +797,12 @@ func createPIPandNIC(machine string, subnetInfo *network.Subnet) (*network.Publi
 				Properties: &network.InterfaceIPConfigurationPropertiesFormat{
 					PublicIPAddress:           &publicIPaddress,
 					PrivateIPAllocationMethod: network.Dynamic,
-					Subnet: subnetInfo}}}}}
-	if _, err := interfacesClient.CreateOrUpdate(resourceGroupName, nicName, nicParameters, nil); err != nil {
+					Subnet: subnetInfo}}},
+			NetworkSecurityGroup: nsg}}
+	if err := runLRO(nicName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := interfacesClient.CreateOrUpdate(resourceGroupName, nicName, nicParameters, cancel)
+		return err
+	}); err != nil {
 		return &publicIPaddress, nil, err
 	}
 
@@ -334,8 +815,265 @@ func createPIPandNIC(machine string, subnetInfo *network.Subnet) (*network.Publi
 	return &publicIPaddress, &nicParameters, nil
 }
 
+// createNSG creates a network security group for machine, opening only the
+// management port appropriate for its OS (22 for Linux, 3389 for Windows) to
+// nsgSourceAddressPrefix.
+func createNSG(machine string, isLinux bool) (*network.SecurityGroup, error) {
+	ruleName, port := "AllowRDP", "3389"
+	if isLinux {
+		ruleName, port = "AllowSSH", "22"
+	}
+
+	nsgName := fmt.Sprintf("nsg-%s", machine)
+	nsgParameters := network.SecurityGroup{
+		Location: &location,
+		Properties: &network.SecurityGroupPropertiesFormat{
+			SecurityRules: &[]network.SecurityRule{{
+				Name: &ruleName,
+				Properties: &network.SecurityRulePropertiesFormat{
+					Protocol:                 network.TCP,
+					SourcePortRange:          to.StringPtr("*"),
+					DestinationPortRange:     &port,
+					SourceAddressPrefix:      &nsgSourceAddressPrefix,
+					DestinationAddressPrefix: to.StringPtr("*"),
+					Access:    network.Allow,
+					Direction: network.Inbound,
+					Priority:  to.Int32Ptr(nsgRulePriority)}}}}}
+	if err := runLRO(nsgName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := nsgClient.CreateOrUpdate(resourceGroupName, nsgName, nsgParameters, cancel)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	nsg, err := nsgClient.Get(resourceGroupName, nsgName, "")
+	if err != nil {
+		return nil, err
+	}
+	return &nsg, nil
+}
+
+// runScaleSet provisions a VM Scale Set fronted by a load balancer instead of the two
+// singleton VMs the default sample flow creates, and exercises scale/upgrade operations.
+func runScaleSet(subnetInfo *network.Subnet) error {
+	fmt.Println("Create load balancer for scale set...")
+	lb, err := createLoadBalancer()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Create '%s' VM scale set...\n", vmssName)
+	vmss, err := setVMSSParameters("Canonical", "UbuntuServer", "16.04.0-LTS", lb, subnetInfo)
+	if err != nil {
+		return err
+	}
+	if err := runLRO(vmssName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := vmssClient.CreateOrUpdate(resourceGroupName, vmssName, vmss, cancel)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Now you can connect to scale set instances via SSH on the NAT pool ports of '%s'\n", vmssName)
+
+	return vmssOperations(vmssName)
+}
+
+// createLoadBalancer creates a public-facing load balancer with a backend pool and a
+// NAT pool used to SSH into individual scale set instances.
+func createLoadBalancer() (*network.LoadBalancer, error) {
+	fmt.Println("\tCreate public IP address for load balancer...")
+	IPname := fmt.Sprintf("pip-%s", vmssName)
+	pipParameters := network.PublicIPAddress{
+		Location: &location,
+		Properties: &network.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: network.Static,
+			DNSSettings: &network.PublicIPAddressDNSSettings{
+				DomainNameLabel: to.StringPtr(fmt.Sprintf("azuresample-%s", vmssName))}}}
+	if err := runLRO(IPname, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := addressClient.CreateOrUpdate(resourceGroupName, IPname, pipParameters, cancel)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	publicIPaddress, err := addressClient.Get(resourceGroupName, IPname, "")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("\tCreate load balancer...")
+	lbName := fmt.Sprintf("lb-%s", vmssName)
+	frontEndName := "loadBalancerFrontEnd"
+	backendPoolName := "backendPool"
+	natPoolName := "natPool"
+
+	lbParameters := network.LoadBalancer{
+		Location: &location,
+		Properties: &network.LoadBalancerPropertiesFormat{
+			FrontendIPConfigurations: &[]network.FrontendIPConfiguration{{
+				Name: &frontEndName,
+				Properties: &network.FrontendIPConfigurationPropertiesFormat{
+					PublicIPAddress: &publicIPaddress}}},
+			BackendAddressPools: &[]network.BackendAddressPool{{
+				Name: &backendPoolName}},
+			InboundNatPools: &[]network.InboundNatPool{{
+				Name: &natPoolName,
+				Properties: &network.InboundNatPoolPropertiesFormat{
+					FrontendIPConfiguration: &network.SubResource{
+						ID: to.StringPtr(frontEndIPConfigID(lbName, frontEndName))},
+					Protocol:               network.TCP,
+					FrontendPortRangeStart: to.Int32Ptr(50000),
+					FrontendPortRangeEnd:   to.Int32Ptr(50119),
+					BackendPort:            to.Int32Ptr(22)}}}}}
+	if err := runLRO(lbName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := lbClient.CreateOrUpdate(resourceGroupName, lbName, lbParameters, cancel)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	lb, err := lbClient.Get(resourceGroupName, lbName, "")
+	if err != nil {
+		return nil, err
+	}
+	return &lb, nil
+}
+
+// frontEndIPConfigID builds the resource ID of a load balancer frontend IP
+// configuration, needed to wire sub-resources before the load balancer itself exists.
+func frontEndIPConfigID(lbName, frontEndName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/loadBalancers/%s/frontendIPConfigurations/%s",
+		subscriptionID, resourceGroupName, lbName, frontEndName)
+}
+
+// setVMSSParameters builds the VirtualMachineScaleSet argument for creating or
+// updating the scale set, wiring its NIC into lb's backend pool and NAT pool.
+func setVMSSParameters(publisher, offer, sku string, lb *network.LoadBalancer, subnetInfo *network.Subnet) (compute.VirtualMachineScaleSet, error) {
+	osProfile, err := setVMSSOSProfile(publisher)
+	if err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+
+	backendPool := (*lb.Properties.BackendAddressPools)[0]
+	natPool := (*lb.Properties.InboundNatPools)[0]
+
+	return compute.VirtualMachineScaleSet{
+		Location: &location,
+		Sku: &compute.Sku{
+			Name:     to.StringPtr(string(compute.StandardDS1)),
+			Tier:     to.StringPtr("Standard"),
+			Capacity: &vmssCapacity},
+		Properties: &compute.VirtualMachineScaleSetProperties{
+			UpgradePolicy: &compute.UpgradePolicy{
+				Mode: compute.Manual},
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+				OsProfile: osProfile,
+				StorageProfile: &compute.VirtualMachineScaleSetStorageProfile{
+					ImageReference: &compute.ImageReference{
+						Publisher: &publisher,
+						Offer:     &offer,
+						Sku:       &sku,
+						Version:   to.StringPtr("latest")},
+					OsDisk: &compute.VirtualMachineScaleSetOSDisk{
+						CreateOption: compute.FromImage,
+						ManagedDisk: &compute.VirtualMachineScaleSetManagedDiskParameters{
+							StorageAccountType: diskStorageAccountType}}},
+				NetworkProfile: &compute.VirtualMachineScaleSetNetworkProfile{
+					NetworkInterfaceConfigurations: &[]compute.VirtualMachineScaleSetNetworkConfiguration{{
+						Name: to.StringPtr(fmt.Sprintf("%s-nic", vmssName)),
+						Properties: &compute.VirtualMachineScaleSetNetworkConfigurationProperties{
+							Primary: to.BoolPtr(true),
+							IPConfigurations: &[]compute.VirtualMachineScaleSetIPConfiguration{{
+								Name: to.StringPtr(fmt.Sprintf("%s-ipconfig", vmssName)),
+								Properties: &compute.VirtualMachineScaleSetIPConfigurationProperties{
+									Subnet: &compute.APIEntityReference{
+										ID: subnetInfo.ID},
+									LoadBalancerBackendAddressPools: &[]compute.SubResource{{ID: backendPool.ID}},
+									LoadBalancerInboundNatPools:     &[]compute.SubResource{{ID: natPool.ID}}}}}}}}}}}}, nil
+}
+
+// setVMSSOSProfile builds the scale set's OsProfile, mirroring setOSProfile's choice
+// of SSH keys for Linux images and a generated password for Windows ones.
+func setVMSSOSProfile(publisher string) (*compute.VirtualMachineScaleSetOSProfile, error) {
+	osProfile := &compute.VirtualMachineScaleSetOSProfile{
+		ComputerNamePrefix: &vmssName,
+		AdminUsername:      to.StringPtr("notadmin")}
+
+	if !isLinuxPublisher(publisher) {
+		password, err := generatePassword()
+		if err != nil {
+			return nil, err
+		}
+		osProfile.AdminPassword = &password
+		return osProfile, nil
+	}
+
+	sshPublicKey, err := getSSHPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	osProfile.LinuxConfiguration = &compute.LinuxConfiguration{
+		DisablePasswordAuthentication: to.BoolPtr(true),
+		SSH: &compute.SSHConfiguration{
+			PublicKeys: &[]compute.SSHPublicKey{{
+				Path:    to.StringPtr(sshPublicKeyPath),
+				KeyData: &sshPublicKey}}}}
+
+	return osProfile, nil
+}
+
+// vmssOperations demonstrates scaling the set out, rolling out a manual upgrade to
+// its instances, and powering off a single instance.
+func vmssOperations(vmssName string) error {
+	fmt.Println("Scale out VM scale set...")
+	vmss, err := vmssClient.Get(resourceGroupName, vmssName)
+	if err != nil {
+		return err
+	}
+	*vmss.Sku.Capacity++
+	if err := runLRO(vmssName, "CreateOrUpdate", func(cancel <-chan struct{}) error {
+		_, err := vmssClient.CreateOrUpdate(resourceGroupName, vmssName, vmss, cancel)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fmt.Println("List scale set instances...")
+	instances, err := vmssVMsClient.List(resourceGroupName, vmssName, "", "", "")
+	if err != nil {
+		return err
+	}
+	if instances.Value == nil || len(*instances.Value) == 0 {
+		return nil
+	}
+
+	instanceIDs := make([]string, 0, len(*instances.Value))
+	for _, instance := range *instances.Value {
+		instanceIDs = append(instanceIDs, *instance.InstanceID)
+	}
+
+	fmt.Println("Manually upgrade scale set instances...")
+	printError(runLRO(vmssName, "UpdateInstances", func(cancel <-chan struct{}) error {
+		_, err := vmssClient.UpdateInstances(resourceGroupName, vmssName, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &instanceIDs}, cancel)
+		return err
+	}))
+
+	fmt.Printf("Power off scale set instance '%s'...\n", instanceIDs[0])
+	printError(runLRO(instanceIDs[0], "PowerOff", func(cancel <-chan struct{}) error {
+		_, err := vmssVMsClient.PowerOff(resourceGroupName, vmssName, instanceIDs[0], cancel)
+		return err
+	}))
+
+	return nil
+}
+
 // setVMparameters builds the VirtualMachine argument for creating or updating a VM.
-func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.VirtualMachine {
+func setVMparameters(vmName, publisher, offer, sku, nicID string) (compute.VirtualMachine, error) {
+	osProfile, err := setOSProfile(vmName, publisher)
+	if err != nil {
+		return compute.VirtualMachine{}, err
+	}
+
 	return compute.VirtualMachine{
 		Location: &location,
 		Properties: &compute.VirtualMachineProperties{
@@ -347,20 +1085,102 @@ func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.Virtua
 					Offer:     &offer,
 					Sku:       &sku,
 					Version:   to.StringPtr("latest")},
-				OsDisk: &compute.OSDisk{
-					Name: to.StringPtr("osDisk"),
-					Vhd: &compute.VirtualHardDisk{
-						URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, vmName))},
-					CreateOption: compute.FromImage}},
-			OsProfile: &compute.OSProfile{
-				ComputerName:  &vmName,
-				AdminUsername: to.StringPtr("notadmin"),
-				AdminPassword: to.StringPtr("Pa$$w0rd1975")},
+				OsDisk: setOSDisk(vmName)},
+			OsProfile: osProfile,
 			NetworkProfile: &compute.NetworkProfile{
 				NetworkInterfaces: &[]compute.NetworkInterfaceReference{{
 					ID: &nicID,
 					Properties: &compute.NetworkInterfaceReferenceProperties{
-						Primary: to.BoolPtr(true)}}}}}}
+						Primary: to.BoolPtr(true)}}}}}}, nil
+}
+
+// setOSDisk builds the OsDisk for vmName, using an Azure Managed Disk when
+// useManagedDisks is set or an unmanaged VHD on a page blob otherwise.
+func setOSDisk(vmName string) *compute.OSDisk {
+	if useManagedDisks {
+		return &compute.OSDisk{
+			Name: to.StringPtr(fmt.Sprintf("%s-osdisk", vmName)),
+			ManagedDisk: &compute.ManagedDiskParameters{
+				StorageAccountType: diskStorageAccountType},
+			CreateOption: compute.FromImage}
+	}
+
+	return &compute.OSDisk{
+		Name: to.StringPtr("osDisk"),
+		Vhd: &compute.VirtualHardDisk{
+			URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, vmName))},
+		CreateOption: compute.FromImage}
+}
+
+// setOSProfile builds the OsProfile for vmName, choosing SSH key auth and optional
+// cloud-init custom data for Linux images, or a generated password for Windows ones.
+func setOSProfile(vmName, publisher string) (*compute.OSProfile, error) {
+	osProfile := &compute.OSProfile{
+		ComputerName:  &vmName,
+		AdminUsername: to.StringPtr("notadmin")}
+
+	customData, err := getCustomData()
+	if err != nil {
+		return nil, err
+	}
+	if customData != "" {
+		osProfile.CustomData = &customData
+	}
+
+	if !isLinuxPublisher(publisher) {
+		password, err := generatePassword()
+		if err != nil {
+			return nil, err
+		}
+		osProfile.AdminPassword = &password
+		return osProfile, nil
+	}
+
+	sshPublicKey, err := getSSHPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	osProfile.LinuxConfiguration = &compute.LinuxConfiguration{
+		DisablePasswordAuthentication: to.BoolPtr(true),
+		SSH: &compute.SSHConfiguration{
+			PublicKeys: &[]compute.SSHPublicKey{{
+				Path:    to.StringPtr(sshPublicKeyPath),
+				KeyData: &sshPublicKey}}}}
+
+	return osProfile, nil
+}
+
+// getSSHPublicKey returns the SSH public key to provision onto Linux VMs, read
+// from the AZURE_SSH_PUBLIC_KEY environment variable.
+func getSSHPublicKey() (string, error) {
+	key := os.Getenv("AZURE_SSH_PUBLIC_KEY")
+	if key == "" {
+		return "", fmt.Errorf("AZURE_SSH_PUBLIC_KEY must be set to the contents of an SSH public key")
+	}
+	return strings.TrimSpace(key), nil
+}
+
+// getCustomData reads an optional cloud-init script from the file named by the
+// AZURE_CUSTOM_DATA_FILE environment variable and base64-encodes it for CustomData.
+func getCustomData() (string, error) {
+	path := os.Getenv("AZURE_CUSTOM_DATA_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read AZURE_CUSTOM_DATA_FILE %q: %s", path, err)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// generatePassword returns a randomly generated password suitable for AdminPassword.
+func generatePassword() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "P@" + base64.RawURLEncoding.EncodeToString(buf), nil
 }
 
 // printVM prints basic info about a Virtual Machine.
@@ -2,11 +2,21 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/Azure-Samples/virtual-machines-go-manage/pkg/auth"
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
 	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
@@ -14,15 +24,52 @@ import (
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
-	"github.com/Azure/go-autorest/autorest/utils"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	vhdURItemplate = "https://%s.blob.core.windows.net/golangcontainer/%s.vhd"
 	linuxVMname    = "linuxVM"
 	windowsVMname  = "windowsVM"
+
+	// sshKeyPath is the base path the SSH key pair generated for Linux VMs is
+	// written to; the public half goes to sshKeyPath + ".pub".
+	sshKeyPath = "sshkey"
+
+	// customDataFileEnvVar names the environment variable pointing at an optional
+	// cloud-init script passed to new VMs via OsProfile.CustomData.
+	customDataFileEnvVar = "AZURE_CUSTOM_DATA_FILE"
+
+	// vmSize is the VM size used for both sample VMs. Standard_DS2_v2 (2 vCPUs)
+	// is used rather than the smaller Standard_DS1_v2 because it's one of the
+	// sizes accelerated networking, enabled below where supported, requires.
+	vmSize = compute.VirtualMachineSizeTypesStandardDS2V2
 )
 
+// acceleratedNetworkingSizes lists the VM sizes this sample knows support
+// accelerated networking; Azure rejects the NIC/VM create for any other size,
+// so enableAcceleratedNetworking must be gated on this list rather than set
+// unconditionally.
+var acceleratedNetworkingSizes = map[compute.VirtualMachineSizeTypes]bool{
+	compute.VirtualMachineSizeTypesStandardDS2V2: true,
+	compute.VirtualMachineSizeTypesStandardDS3V2: true,
+	compute.VirtualMachineSizeTypesStandardDS4V2: true,
+	compute.VirtualMachineSizeTypesStandardDS5V2: true,
+}
+
+// linuxPublishers lists the image publishers this sample treats as Linux for
+// the purpose of choosing an OsProfile (SSH keys) over a Windows one (password).
+var linuxPublishers = []string{"Canonical", "CoreOS", "OpenLogic", "RedHat", "SUSE"}
+
+func isLinuxPublisher(publisher string) bool {
+	for _, p := range linuxPublishers {
+		if strings.EqualFold(p, publisher) {
+			return true
+		}
+	}
+	return false
+}
+
 // This example requires that the following environment vars are set:
 //
 // AZURE_TENANT_ID: contains your Azure Active Directory tenant ID or domain
@@ -38,22 +85,228 @@ var (
 	vNetName    = "vNet"
 	subnetName  = "subnet"
 
+	// useManagedDisks selects Azure Managed Disks over unmanaged VHDs-on-page-blobs
+	// for OS and data disks when AZURE_USE_MANAGED_DISKS is set to "1".
+	useManagedDisks = os.Getenv("AZURE_USE_MANAGED_DISKS") == "1"
+
+	// vmMode picks between provisioning the two singleton VMs ("singleVM", the
+	// default) and a load-balanced VM Scale Set ("scaleSet"), via AZURE_VM_MODE.
+	vmMode = getVMMode()
+
+	// vmssName names the scale set created when vmMode is "scaleSet".
+	vmssName = "vmss"
+
+	// vmssCapacity is the initial instance count of the scale set, set via
+	// AZURE_VMSS_CAPACITY (default 2).
+	vmssCapacity = getVMSSCapacity()
+
+	subscriptionID string
+
+	// names generates this run's resource names; set in createNeededResources.
+	names *NameGenerator
+
 	groupClient      resources.GroupsClient
 	accountClient    storage.AccountsClient
 	vNetClient       network.VirtualNetworksClient
 	subnetClient     network.SubnetsClient
 	addressClient    network.PublicIPAddressesClient
 	interfacesClient network.InterfacesClient
+	nsgClient        network.SecurityGroupsClient
 	vmClient         compute.VirtualMachinesClient
+	disksClient      compute.DisksClient
+	snapshotsClient  compute.SnapshotsClient
+	imagesClient     compute.ImagesClient
+	lbClient         network.LoadBalancersClient
+	vmssClient       compute.VirtualMachineScaleSetsClient
+	vmssVMsClient    compute.VirtualMachineScaleSetVMsClient
 )
 
+// getVMMode returns "scaleSet" when AZURE_VM_MODE requests a VM Scale Set, and
+// "singleVM" (the original two-VM demo) otherwise.
+func getVMMode() string {
+	if os.Getenv("AZURE_VM_MODE") == "scaleSet" {
+		return "scaleSet"
+	}
+	return "singleVM"
+}
+
+// getVMSSCapacity returns the configured scale set capacity from
+// AZURE_VMSS_CAPACITY, defaulting to 2 when unset or invalid.
+func getVMSSCapacity() int64 {
+	if value := os.Getenv("AZURE_VMSS_CAPACITY"); value != "" {
+		if capacity, err := strconv.Atoi(value); err == nil && capacity > 0 {
+			return int64(capacity)
+		}
+	}
+	return 2
+}
+
+// NameGenerator derives DNS-safe, collision-avoiding resource names for a
+// single run of the sample from a seed printed at startup, so a run's names
+// can be reproduced by setting AZURE_NAME_SEED to that value. It's safe for
+// concurrent use, since createVM calls into it from both the Linux and
+// Windows VM goroutines.
+type NameGenerator struct {
+	seed int64
+
+	mu   sync.Mutex
+	rand *mathrand.Rand
+}
+
+// newNameGenerator seeds a NameGenerator from AZURE_NAME_SEED if it's set to a
+// valid integer, or the current time otherwise.
+func newNameGenerator() *NameGenerator {
+	seed := time.Now().UnixNano()
+	if value := os.Getenv("AZURE_NAME_SEED"); value != "" {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			seed = parsed
+		}
+	}
+	return &NameGenerator{seed: seed, rand: mathrand.New(mathrand.NewSource(seed))}
+}
+
+// randomSuffix returns a random lowercase alphanumeric string of length n.
+func (g *NameGenerator) randomSuffix(n int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	suffix := make([]byte, n)
+	for i := range suffix {
+		suffix[i] = alphabet[g.rand.Intn(len(alphabet))]
+	}
+	return string(suffix)
+}
+
+// storageAccountName returns an available storage account name derived from
+// base, sanitized to 3-24 lowercase alphanumeric characters, retrying with a
+// new random suffix and exponential backoff until
+// AccountsClient.CheckNameAvailability reports one is free, for up to 10 attempts.
+func (g *NameGenerator) storageAccountName(base string) (string, error) {
+	name := sanitizeStorageAccountName(base)
+	if len(name) < 3 {
+		name = sanitizeStorageAccountName(name + g.randomSuffix(6))
+	}
+	backoff := time.Second
+	for attempt := 0; attempt < 10; attempt++ {
+		result, err := accountClient.CheckNameAvailability(storage.AccountCheckNameAvailabilityParameters{
+			Name: &name,
+			Type: to.StringPtr("Microsoft.Storage/storageAccounts"),
+		})
+		if err != nil {
+			return "", err
+		}
+		if result.NameAvailable == nil || *result.NameAvailable {
+			return name, nil
+		}
+
+		reason := "unknown reason"
+		if result.Message != nil {
+			reason = *result.Message
+		}
+		fmt.Printf("\tStorage account name '%s' is unavailable (%s), trying another one...\n", name, reason)
+		name = sanitizeStorageAccountName(base + g.randomSuffix(6))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return "", fmt.Errorf("could not find an available storage account name derived from %q", base)
+}
+
+// dnsLabel returns an available DNS label derived from base, sanitized to
+// lowercase alphanumerics and hyphens no longer than 63 characters, retrying
+// with a new random suffix and exponential backoff until
+// PublicIPAddressesClient.CheckDNSNameAvailability reports one is free, for up
+// to 10 attempts.
+func (g *NameGenerator) dnsLabel(base string) (string, error) {
+	label := sanitizeDNSLabel(base)
+	backoff := time.Second
+	for attempt := 0; attempt < 10; attempt++ {
+		result, err := addressClient.CheckDNSNameAvailability(location, label)
+		if err != nil {
+			return "", err
+		}
+		if result.Available == nil || *result.Available {
+			return label, nil
+		}
+
+		fmt.Printf("\tDNS label '%s' is unavailable, trying another one...\n", label)
+		label = sanitizeDNSLabel(fmt.Sprintf("%s-%s", base, g.randomSuffix(6)))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return "", fmt.Errorf("could not find an available DNS label derived from %q", base)
+}
+
+// sanitizeStorageAccountName lowercases name, strips anything but letters and
+// digits, and truncates it to the 24-character limit storage account names allow.
+func sanitizeStorageAccountName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	name = b.String()
+	if len(name) > 24 {
+		name = name[:24]
+	}
+	return name
+}
+
+// sanitizeDNSLabel lowercases label, strips anything but letters, digits and
+// hyphens, and truncates it to the 63-character limit DNS labels allow.
+func sanitizeDNSLabel(label string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(label) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	label = b.String()
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
+// resolveNames seeds the package's NameGenerator, derives this run's actual
+// resource names from it (appending a random suffix to the defaults, and
+// probing storage.AccountsClient for an available storage account name), and
+// prints them so the run can be reproduced via AZURE_NAME_SEED.
+func resolveNames() {
+	names = newNameGenerator()
+	suffix := names.randomSuffix(6)
+
+	groupName = fmt.Sprintf("%s-%s", groupName, suffix)
+	vNetName = fmt.Sprintf("%s-%s", vNetName, suffix)
+	subnetName = fmt.Sprintf("%s-%s", subnetName, suffix)
+	vmssName = fmt.Sprintf("%s-%s", vmssName, suffix)
+
+	if !useManagedDisks {
+		var err error
+		accountName, err = names.storageAccountName(accountName)
+		onErrorFail(err, "names.storageAccountName failed")
+	}
+
+	fmt.Printf("Resource names for this run (AZURE_NAME_SEED=%d):\n", names.seed)
+	fmt.Printf("\tResource group:  %s\n", groupName)
+	fmt.Printf("\tStorage account: %s\n", accountName)
+	fmt.Printf("\tVirtual network: %s\n", vNetName)
+	fmt.Printf("\tSubnet:          %s\n", subnetName)
+	if vmMode == "scaleSet" {
+		fmt.Printf("\tVM scale set:    %s\n", vmssName)
+	}
+}
+
 func init() {
-	subscriptionID := getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
+	subscriptionID = getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
 
-	authorizer, err := utils.GetAuthorizer(azure.PublicCloud)
-	onErrorFail(err, "utils.GetAuthorizer failed")
+	env, err := auth.GetEnvironment()
+	onErrorFail(err, "auth.GetEnvironment failed")
 
-	createClients(subscriptionID, authorizer)
+	authorizer, err := auth.NewAuthorizer(env)
+	onErrorFail(err, "auth.NewAuthorizer failed")
+
+	createClients(subscriptionID, env, authorizer)
 }
 
 func main() {
@@ -61,6 +314,11 @@ func main() {
 	subnet := createNeededResources()
 	defer groupClient.Delete(groupName, nil)
 
+	if vmMode == "scaleSet" {
+		runScaleSet(subnet)
+		return
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go createVM(linuxVMname, "Canonical", "UbuntuServer", "16.04.0-LTS", subnet, &wg)
@@ -92,6 +350,8 @@ func main() {
 
 // createNeededResources creates all common resources needed before creating VMs.
 func createNeededResources() *network.Subnet {
+	resolveNames()
+
 	fmt.Println("Create needed resources")
 	fmt.Printf("\tCreate resource group '%s'...\n", groupName)
 	resourceGroupParameters := resources.Group{
@@ -102,18 +362,22 @@ func createNeededResources() *network.Subnet {
 	onErrorFail(err, fmt.Sprintf("groupClient.CreateOrUpdate failed for resource group '%s'", groupName))
 	fmt.Printf("\tCreated resource group '%s' successfully\n", groupName)
 
-	fmt.Printf("\tCreate storage account '%s'...\n", accountName)
-	accountParameters := storage.AccountCreateParameters{
-		Sku: &storage.Sku{
-			Name: storage.StandardLRS,
-		},
-		Location: &location,
-		AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{},
-	}
+	if useManagedDisks {
+		fmt.Println("\tSkip storage account creation, using managed disks...")
+	} else {
+		fmt.Printf("\tCreate storage account '%s'...\n", accountName)
+		accountParameters := storage.AccountCreateParameters{
+			Sku: &storage.Sku{
+				Name: storage.StandardLRS,
+			},
+			Location: &location,
+			AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{},
+		}
 
-	_, errChan := accountClient.Create(groupName, accountName, accountParameters, nil)
-	onErrorFail(<-errChan, fmt.Sprintf("accountClient.Create failed for storage account '%s'", accountName))
-	fmt.Printf("\tCreated storage account '%s' successfully\n", accountName)
+		_, errChan := accountClient.Create(groupName, accountName, accountParameters, nil)
+		onErrorFail(<-errChan, fmt.Sprintf("accountClient.Create failed for storage account '%s'", accountName))
+		fmt.Printf("\tCreated storage account '%s' successfully\n", accountName)
+	}
 
 	vNetParameters := network.VirtualNetwork{
 		Location: &location,
@@ -125,7 +389,7 @@ func createNeededResources() *network.Subnet {
 	}
 
 	fmt.Printf("\tCreate virtual network '%s'...\n", vNetName)
-	_, errChan = vNetClient.CreateOrUpdate(groupName, vNetName, vNetParameters, nil)
+	_, errChan := vNetClient.CreateOrUpdate(groupName, vNetName, vNetParameters, nil)
 	onErrorFail(<-errChan, fmt.Sprintf("vNetClient.CreateOrUpdate failed for '%s'", vNetName))
 	fmt.Printf("\tCreated virtual network '%s' successfully\n", vNetName)
 
@@ -151,80 +415,260 @@ func createNeededResources() *network.Subnet {
 func createVM(vmName, publisher, offer, sku string, subnetInfo *network.Subnet, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	publicIPaddress, nicParameters := createPIPandNIC(vmName, subnetInfo)
+	isLinux := isLinuxPublisher(publisher)
+	ruleName, port, sourcePrefix := "AllowRDP", "3389", "*"
+	if isLinux {
+		ruleName, port = "AllowSSH", "22"
+		sourcePrefix = getCallerIP()
+	}
+
+	specs := []NICSpec{
+		{
+			suffix:                      "primary",
+			publicIP:                    true,
+			staticPublicIP:              isLinux,
+			enableAcceleratedNetworking: acceleratedNetworkingSizes[vmSize],
+			nsgRules:                    &[]network.SecurityRule{managementSecurityRule(ruleName, port, sourcePrefix)},
+		},
+	}
+	if isLinux {
+		// A second NIC with no public IP or NSG demonstrates attaching an
+		// additional network interface to a VM.
+		specs = append(specs, NICSpec{suffix: "secondary"})
+	}
 
 	fmt.Printf("Create '%s' VM...\n", vmName)
-	vm := setVMparameters(vmName, publisher, offer, sku, *nicParameters.ID)
+	nicRefs, publicIPaddress := createPIPandNICs(vmName, specs, subnetInfo)
+	vm := setVMparameters(vmName, publisher, offer, sku, nicRefs)
 	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, vm, nil)
 	onErrorFail(<-errChan, "createVM failed")
 
-	fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' with password '%s'\n",
-		vmName,
-		*vm.OsProfile.AdminUsername,
-		*publicIPaddress.DNSSettings.Fqdn,
-		*vm.OsProfile.AdminPassword)
+	if isLinux {
+		fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' using your SSH key (locked down to '%s')\n",
+			vmName,
+			*vm.OsProfile.AdminUsername,
+			*publicIPaddress.DNSSettings.Fqdn,
+			sourcePrefix)
+	} else {
+		fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' with password '%s'\n",
+			vmName,
+			*vm.OsProfile.AdminUsername,
+			*publicIPaddress.DNSSettings.Fqdn,
+			*vm.OsProfile.AdminPassword)
+	}
 }
 
-// createPIPandNIC creates a public IP address and a network interface in an existing subnet.
-// It returns a network interface ready to be used to create a virtual machine.
-func createPIPandNIC(machine string, subnetInfo *network.Subnet) (*network.PublicIPAddress, *network.Interface) {
-	fmt.Printf("Create PIP and NIC for '%s' VM...\n", machine)
-	IPname := fmt.Sprintf("pip-%s", machine)
-	fmt.Printf("\tCreate public IP address '%s'...\n", IPname)
-	pipParameters := network.PublicIPAddress{
-		Location: &location,
-		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
-			DNSSettings: &network.PublicIPAddressDNSSettings{
-				DomainNameLabel: to.StringPtr(fmt.Sprintf("azuresample-%s", strings.ToLower(machine[:5]))),
-			},
+// NICSpec describes one network interface to create and attach to a VM. The
+// first NICSpec passed to createPIPandNICs becomes the VM's primary NIC;
+// only a NIC with publicIP set is given a public IP address.
+type NICSpec struct {
+	suffix                      string
+	publicIP                    bool
+	staticPublicIP              bool
+	enableAcceleratedNetworking bool
+	nsgRules                    *[]network.SecurityRule
+}
+
+// managementSecurityRule builds an inbound NSG rule named name allowing TCP
+// traffic on port from sourcePrefix (a CIDR, single address, or "*" for any).
+func managementSecurityRule(name, port, sourcePrefix string) network.SecurityRule {
+	return network.SecurityRule{
+		Name: to.StringPtr(name),
+		SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+			Protocol:                 network.TCP,
+			SourcePortRange:          to.StringPtr("*"),
+			DestinationPortRange:     to.StringPtr(port),
+			SourceAddressPrefix:      to.StringPtr(sourcePrefix),
+			DestinationAddressPrefix: to.StringPtr("*"),
+			Access:                   network.Allow,
+			Direction:                network.Inbound,
+			Priority:                 to.Int32Ptr(100),
 		},
 	}
+}
 
-	_, errChan := addressClient.CreateOrUpdate(groupName, IPname, pipParameters, nil)
-	onErrorFail(<-errChan, fmt.Sprintf("addressClient.CreateOrUpdate '%s' failed", IPname))
-	fmt.Printf("\tCreated public IP address %s\n", IPname)
+// getCallerIP discovers the public IP address this process is making outbound
+// requests from, for use as the source address restriction on a management
+// NSG rule. It falls back to "*" (open to the world) if the lookup fails.
+func getCallerIP() string {
+	resp, err := http.Get("https://api.ipify.org")
+	if err != nil {
+		fmt.Printf("\tcouldn't discover egress IP, leaving rule open to '*': %s\n", err)
+		return "*"
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("\tcouldn't discover egress IP, leaving rule open to '*': %s\n", resp.Status)
+		return "*"
+	}
 
-	fmt.Printf("\tGet public IP address info for '%s'...\n", IPname)
-	publicIPaddress, err := addressClient.Get(groupName, IPname, "")
-	onErrorFail(err, fmt.Sprintf("addressClient.Get for IP '%s' failed", IPname))
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf("\tcouldn't read egress IP response, leaving rule open to '*': %s\n", err)
+		return "*"
+	}
+	return strings.TrimSpace(string(body))
+}
 
-	nicName := fmt.Sprintf("nic-%s", machine)
-	fmt.Printf("\tCreate NIC '%s'...\n", nicName)
+// createPIPandNICs creates the public IPs, network security groups and network
+// interfaces described by specs in an existing subnet, and returns the resulting
+// NetworkInterfaceReferences (with the first spec marked Primary) along with the
+// primary NIC's public IP address, if any.
+func createPIPandNICs(machine string, specs []NICSpec, subnetInfo *network.Subnet) ([]compute.NetworkInterfaceReference, *network.PublicIPAddress) {
+	fmt.Printf("Create PIP(s) and NIC(s) for '%s' VM...\n", machine)
+
+	var primaryIPaddress *network.PublicIPAddress
+	nicRefs := make([]compute.NetworkInterfaceReference, len(specs))
+	for i, spec := range specs {
+		nic, publicIPaddress := createPIPandNIC(machine, spec, subnetInfo)
+		if i == 0 {
+			primaryIPaddress = publicIPaddress
+		}
+		nicRefs[i] = compute.NetworkInterfaceReference{
+			ID: nic.ID,
+			NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
+				Primary: to.BoolPtr(i == 0),
+			},
+		}
+	}
+	return nicRefs, primaryIPaddress
+}
 
+// createPIPandNIC creates spec's public IP address (if any), network security
+// group (if any) and network interface in an existing subnet. It returns a
+// network interface ready to be attached to a virtual machine.
+func createPIPandNIC(machine string, spec NICSpec, subnetInfo *network.Subnet) (*network.Interface, *network.PublicIPAddress) {
+	var publicIPaddress *network.PublicIPAddress
+	if spec.publicIP {
+		publicIPaddress = createPublicIP(machine, spec)
+	}
+
+	var nsg *network.SecurityGroup
+	if spec.nsgRules != nil {
+		nsg = createNSG(machine, spec)
+	}
+
+	nicName := fmt.Sprintf("nic-%s-%s", machine, spec.suffix)
+	fmt.Printf("\tCreate NIC '%s'...\n", nicName)
 	nicParameters := network.Interface{
 		Location: &location,
 		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
 			IPConfigurations: &[]network.InterfaceIPConfiguration{
 				{
-					Name: to.StringPtr(fmt.Sprintf("IPconfig-%s", machine)),
+					Name: to.StringPtr(fmt.Sprintf("IPconfig-%s-%s", machine, spec.suffix)),
 					InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
-						PublicIPAddress:           &publicIPaddress,
+						PublicIPAddress:           publicIPaddress,
 						PrivateIPAllocationMethod: network.Dynamic,
-						Subnet: subnetInfo,
+						Subnet:                    subnetInfo,
 					},
 				},
 			},
+			NetworkSecurityGroup:        nsg,
+			EnableAcceleratedNetworking: to.BoolPtr(spec.enableAcceleratedNetworking),
 		},
 	}
 
-	_, errChan = interfacesClient.CreateOrUpdate(groupName, nicName, nicParameters, nil)
+	_, errChan := interfacesClient.CreateOrUpdate(groupName, nicName, nicParameters, nil)
 	onErrorFail(<-errChan, fmt.Sprintf("interfacesClient.CreateOrUpdate for NIC '%s' failed", nicName))
 	fmt.Printf("\tCreated NIC '%s' successfully\n", nicName)
 
-	fmt.Printf("\tGet NIC info for %s...\n", nicName)
-	nicParameters, err = interfacesClient.Get(groupName, nicName, "")
+	nicParameters, err := interfacesClient.Get(groupName, nicName, "")
 	onErrorFail(err, fmt.Sprintf("interfaces.Get for NIC '%s' failed", nicName))
 
-	return &publicIPaddress, &nicParameters
+	return &nicParameters, publicIPaddress
+}
+
+// createPublicIP creates spec's public IP address, allocated statically with a
+// Standard SKU when spec.staticPublicIP is set or dynamically with a Basic SKU
+// otherwise.
+func createPublicIP(machine string, spec NICSpec) *network.PublicIPAddress {
+	IPname := fmt.Sprintf("pip-%s-%s", machine, spec.suffix)
+	fmt.Printf("\tCreate public IP address '%s'...\n", IPname)
+	dnsLabel, err := names.dnsLabel(fmt.Sprintf("azuresample-%s-%s", strings.ToLower(machine[:5]), spec.suffix))
+	onErrorFail(err, "names.dnsLabel failed")
+
+	pipParameters := network.PublicIPAddress{
+		Location: &location,
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			DNSSettings: &network.PublicIPAddressDNSSettings{
+				DomainNameLabel: &dnsLabel,
+			},
+		},
+	}
+	if spec.staticPublicIP {
+		pipParameters.PublicIPAddressPropertiesFormat.PublicIPAllocationMethod = network.Static
+		pipParameters.Sku = &network.PublicIPAddressSku{Name: network.PublicIPAddressSkuNameStandard}
+	}
+
+	_, errChan := addressClient.CreateOrUpdate(groupName, IPname, pipParameters, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("addressClient.CreateOrUpdate '%s' failed", IPname))
+	fmt.Printf("\tCreated public IP address %s\n", IPname)
+
+	publicIPaddress, err := addressClient.Get(groupName, IPname, "")
+	onErrorFail(err, fmt.Sprintf("addressClient.Get for IP '%s' failed", IPname))
+	return &publicIPaddress
+}
+
+// createNSG creates the network security group described by spec.nsgRules for machine.
+func createNSG(machine string, spec NICSpec) *network.SecurityGroup {
+	nsgName := fmt.Sprintf("nsg-%s-%s", machine, spec.suffix)
+	fmt.Printf("\tCreate network security group '%s'...\n", nsgName)
+	nsgParameters := network.SecurityGroup{
+		Location: &location,
+		SecurityGroupPropertiesFormat: &network.SecurityGroupPropertiesFormat{
+			SecurityRules: spec.nsgRules,
+		},
+	}
+
+	_, errChan := nsgClient.CreateOrUpdate(groupName, nsgName, nsgParameters, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("nsgClient.CreateOrUpdate failed for '%s'", nsgName))
+	fmt.Printf("\tCreated network security group '%s' successfully\n", nsgName)
+
+	nsg, err := nsgClient.Get(groupName, nsgName, "")
+	onErrorFail(err, fmt.Sprintf("nsgClient.Get failed for '%s'", nsgName))
+	return &nsg
 }
 
 // setVMparameters builds the VirtualMachine argument for creating or updating a VM.
-func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.VirtualMachine {
+func setVMparameters(vmName, publisher, offer, sku string, nicRefs []compute.NetworkInterfaceReference) compute.VirtualMachine {
+	osProfile := &compute.OSProfile{
+		ComputerName:  &vmName,
+		AdminUsername: to.StringPtr("notadmin"),
+		CustomData:    getCustomData(),
+	}
+	if isLinuxPublisher(publisher) {
+		osProfile.LinuxConfiguration = &compute.LinuxConfiguration{
+			DisablePasswordAuthentication: to.BoolPtr(true),
+			SSH: &compute.SSHConfiguration{
+				PublicKeys: &[]compute.SSHPublicKey{
+					{
+						Path:    to.StringPtr("/home/notadmin/.ssh/authorized_keys"),
+						KeyData: to.StringPtr(generateSSHKeyPair()),
+					},
+				},
+			},
+		}
+	} else {
+		osProfile.AdminPassword = to.StringPtr("Pa$$w0rd1975")
+	}
+
+	osDisk := &compute.OSDisk{
+		Name:         to.StringPtr("osDisk"),
+		CreateOption: compute.DiskCreateOptionTypesFromImage,
+	}
+	if useManagedDisks {
+		osDisk.ManagedDisk = &compute.ManagedDiskParameters{StorageAccountType: compute.PremiumLRS}
+	} else {
+		osDisk.Vhd = &compute.VirtualHardDisk{
+			URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, vmName)),
+		}
+	}
+
 	return compute.VirtualMachine{
 		Location: &location,
 		VirtualMachineProperties: &compute.VirtualMachineProperties{
 			HardwareProfile: &compute.HardwareProfile{
-				VMSize: compute.VirtualMachineSizeTypesStandardDS1V2,
+				VMSize: vmSize,
 			},
 			StorageProfile: &compute.StorageProfile{
 				ImageReference: &compute.ImageReference{
@@ -233,25 +677,196 @@ func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.Virtua
 					Sku:       &sku,
 					Version:   to.StringPtr("latest"),
 				},
-				OsDisk: &compute.OSDisk{
-					Name: to.StringPtr("osDisk"),
-					Vhd: &compute.VirtualHardDisk{
-						URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, vmName)),
+				OsDisk: osDisk,
+			},
+			OsProfile: osProfile,
+			NetworkProfile: &compute.NetworkProfile{
+				NetworkInterfaces: &nicRefs,
+			},
+		},
+	}
+}
+
+// generateSSHKeyPair creates a new ed25519 key pair, writes the private key to
+// sshKeyPath and the public key to sshKeyPath + ".pub", and returns the public
+// key in the authorized_keys format new Linux VMs are provisioned with.
+func generateSSHKeyPair() string {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	onErrorFail(err, "ed25519.GenerateKey failed")
+
+	privBlock, err := ssh.MarshalPrivateKey(priv, "")
+	onErrorFail(err, "ssh.MarshalPrivateKey failed")
+	onErrorFail(ioutil.WriteFile(sshKeyPath, pem.EncodeToMemory(privBlock), 0600),
+		fmt.Sprintf("writing private key to '%s' failed", sshKeyPath))
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	onErrorFail(err, "ssh.NewPublicKey failed")
+	authorizedKey := ssh.MarshalAuthorizedKey(sshPub)
+	onErrorFail(ioutil.WriteFile(sshKeyPath+".pub", authorizedKey, 0644),
+		fmt.Sprintf("writing public key to '%s.pub' failed", sshKeyPath))
+
+	return strings.TrimSpace(string(authorizedKey))
+}
+
+// getCustomData reads and base64-encodes the cloud-init file named by
+// AZURE_CUSTOM_DATA_FILE, if set, for use as OsProfile.CustomData.
+func getCustomData() *string {
+	path := os.Getenv(customDataFileEnvVar)
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	onErrorFail(err, fmt.Sprintf("reading custom data file '%s' failed", path))
+	encoded := base64.StdEncoding.EncodeToString(data)
+	return &encoded
+}
+
+// runScaleSet provisions a VM Scale Set fronted by a load balancer instead of the two
+// singleton VMs the default sample flow creates, and demonstrates scale-out and
+// per-instance operations.
+func runScaleSet(subnetInfo *network.Subnet) {
+	fmt.Println("Create load balancer for scale set...")
+	lb := createLoadBalancer()
+
+	fmt.Printf("Create '%s' VM scale set...\n", vmssName)
+	vmss := setVMSSParameters("Canonical", "UbuntuServer", "16.04.0-LTS", lb, subnetInfo)
+	_, errChan := vmssClient.CreateOrUpdate(groupName, vmssName, vmss, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("vmssClient.CreateOrUpdate failed for '%s'", vmssName))
+	fmt.Printf("\tCreated VM scale set '%s' successfully\n", vmssName)
+
+	fmt.Printf("Now you can connect to scale set instances via SSH on the NAT pool ports of '%s'\n", vmssName)
+
+	vmssOperations(vmssName)
+}
+
+// createLoadBalancer creates a public-facing load balancer with a backend pool and a
+// NAT pool used to SSH into individual scale set instances.
+func createLoadBalancer() *network.LoadBalancer {
+	IPname := fmt.Sprintf("pip-%s", vmssName)
+	fmt.Printf("\tCreate public IP address '%s'...\n", IPname)
+	dnsLabel, err := names.dnsLabel(fmt.Sprintf("azuresample-%s", vmssName))
+	onErrorFail(err, "names.dnsLabel failed")
+
+	pipParameters := network.PublicIPAddress{
+		Location: &location,
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			DNSSettings: &network.PublicIPAddressDNSSettings{
+				DomainNameLabel: &dnsLabel,
+			},
+		},
+	}
+	_, errChan := addressClient.CreateOrUpdate(groupName, IPname, pipParameters, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("addressClient.CreateOrUpdate '%s' failed", IPname))
+
+	publicIPaddress, err := addressClient.Get(groupName, IPname, "")
+	onErrorFail(err, fmt.Sprintf("addressClient.Get for IP '%s' failed", IPname))
+
+	lbName := fmt.Sprintf("lb-%s", vmssName)
+	frontEndName := "loadBalancerFrontEnd"
+	backendPoolName := "backendPool"
+	natPoolName := "natPool"
+
+	fmt.Printf("\tCreate load balancer '%s'...\n", lbName)
+	lbParameters := network.LoadBalancer{
+		Location: &location,
+		LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{
+			FrontendIPConfigurations: &[]network.FrontendIPConfiguration{
+				{
+					Name: &frontEndName,
+					FrontendIPConfigurationPropertiesFormat: &network.FrontendIPConfigurationPropertiesFormat{
+						PublicIPAddress: &publicIPaddress,
 					},
-					CreateOption: compute.DiskCreateOptionTypesFromImage,
 				},
 			},
-			OsProfile: &compute.OSProfile{
-				ComputerName:  &vmName,
-				AdminUsername: to.StringPtr("notadmin"),
-				AdminPassword: to.StringPtr("Pa$$w0rd1975"),
+			BackendAddressPools: &[]network.BackendAddressPool{
+				{Name: &backendPoolName},
 			},
-			NetworkProfile: &compute.NetworkProfile{
-				NetworkInterfaces: &[]compute.NetworkInterfaceReference{
-					{
-						ID: &nicID,
-						NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
-							Primary: to.BoolPtr(true),
+			InboundNatPools: &[]network.InboundNatPool{
+				{
+					Name: &natPoolName,
+					InboundNatPoolPropertiesFormat: &network.InboundNatPoolPropertiesFormat{
+						FrontendIPConfiguration: &network.SubResource{
+							ID: to.StringPtr(frontEndIPConfigID(lbName, frontEndName)),
+						},
+						Protocol:               network.TCP,
+						FrontendPortRangeStart: to.Int32Ptr(50000),
+						FrontendPortRangeEnd:   to.Int32Ptr(50119),
+						BackendPort:            to.Int32Ptr(22),
+					},
+				},
+			},
+		},
+	}
+	_, errChan = lbClient.CreateOrUpdate(groupName, lbName, lbParameters, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("lbClient.CreateOrUpdate failed for '%s'", lbName))
+	fmt.Printf("\tCreated load balancer '%s' successfully\n", lbName)
+
+	lb, err := lbClient.Get(groupName, lbName, "")
+	onErrorFail(err, fmt.Sprintf("lbClient.Get failed for '%s'", lbName))
+	return &lb
+}
+
+// frontEndIPConfigID builds the resource ID of a load balancer frontend IP
+// configuration, needed to wire the NAT pool before the load balancer itself exists.
+func frontEndIPConfigID(lbName, frontEndName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/loadBalancers/%s/frontendIPConfigurations/%s",
+		subscriptionID, groupName, lbName, frontEndName)
+}
+
+// setVMSSParameters builds the VirtualMachineScaleSet argument for creating or
+// updating the scale set, wiring its NIC into lb's backend pool and NAT pool.
+func setVMSSParameters(publisher, offer, sku string, lb *network.LoadBalancer, subnetInfo *network.Subnet) compute.VirtualMachineScaleSet {
+	backendPool := (*lb.BackendAddressPools)[0]
+	natPool := (*lb.InboundNatPools)[0]
+
+	osDisk := &compute.VirtualMachineScaleSetOSDisk{
+		CreateOption: compute.DiskCreateOptionTypesFromImage,
+	}
+	if useManagedDisks {
+		osDisk.ManagedDisk = &compute.VirtualMachineScaleSetManagedDiskParameters{StorageAccountType: compute.PremiumLRS}
+	} else {
+		osDisk.VhdContainers = &[]string{fmt.Sprintf("https://%s.blob.core.windows.net/golangcontainer", accountName)}
+	}
+
+	return compute.VirtualMachineScaleSet{
+		Location: &location,
+		Sku: &compute.Sku{
+			Name:     to.StringPtr(string(vmSize)),
+			Tier:     to.StringPtr("Standard"),
+			Capacity: &vmssCapacity,
+		},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			UpgradePolicy: &compute.UpgradePolicy{
+				Mode: compute.Manual,
+			},
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+				OsProfile: setVMSSOSProfile(publisher),
+				StorageProfile: &compute.VirtualMachineScaleSetStorageProfile{
+					ImageReference: &compute.ImageReference{
+						Publisher: &publisher,
+						Offer:     &offer,
+						Sku:       &sku,
+						Version:   to.StringPtr("latest"),
+					},
+					OsDisk: osDisk,
+				},
+				NetworkProfile: &compute.VirtualMachineScaleSetNetworkProfile{
+					NetworkInterfaceConfigurations: &[]compute.VirtualMachineScaleSetNetworkConfiguration{
+						{
+							Name: to.StringPtr(fmt.Sprintf("%s-nic", vmssName)),
+							VirtualMachineScaleSetNetworkConfigurationProperties: &compute.VirtualMachineScaleSetNetworkConfigurationProperties{
+								Primary: to.BoolPtr(true),
+								IPConfigurations: &[]compute.VirtualMachineScaleSetIPConfiguration{
+									{
+										Name: to.StringPtr(fmt.Sprintf("%s-ipconfig", vmssName)),
+										VirtualMachineScaleSetIPConfigurationProperties: &compute.VirtualMachineScaleSetIPConfigurationProperties{
+											Subnet:                          &compute.APIEntityReference{ID: subnetInfo.ID},
+											LoadBalancerBackendAddressPools: &[]compute.SubResource{{ID: backendPool.ID}},
+											LoadBalancerInboundNatPools:     &[]compute.SubResource{{ID: natPool.ID}},
+										},
+									},
+								},
+							},
 						},
 					},
 				},
@@ -260,6 +875,55 @@ func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.Virtua
 	}
 }
 
+// setVMSSOSProfile builds the scale set's OsProfile, mirroring setVMparameters'
+// choice of SSH keys for Linux images and a fixed password for Windows ones.
+func setVMSSOSProfile(publisher string) *compute.VirtualMachineScaleSetOSProfile {
+	osProfile := &compute.VirtualMachineScaleSetOSProfile{
+		ComputerNamePrefix: &vmssName,
+		AdminUsername:      to.StringPtr("notadmin"),
+	}
+
+	if !isLinuxPublisher(publisher) {
+		osProfile.AdminPassword = to.StringPtr("Pa$$w0rd1975")
+		return osProfile
+	}
+
+	osProfile.LinuxConfiguration = &compute.LinuxConfiguration{
+		DisablePasswordAuthentication: to.BoolPtr(true),
+		SSH: &compute.SSHConfiguration{
+			PublicKeys: &[]compute.SSHPublicKey{
+				{
+					Path:    to.StringPtr("/home/notadmin/.ssh/authorized_keys"),
+					KeyData: to.StringPtr(generateSSHKeyPair()),
+				},
+			},
+		},
+	}
+	return osProfile
+}
+
+// vmssOperations demonstrates scaling the set out and powering off a single instance.
+func vmssOperations(vmssName string) {
+	fmt.Println("Scale out VM scale set...")
+	vmss, err := vmssClient.Get(groupName, vmssName)
+	onErrorFail(err, fmt.Sprintf("vmssClient.Get failed for '%s'", vmssName))
+	*vmss.Sku.Capacity++
+	_, errChan := vmssClient.CreateOrUpdate(groupName, vmssName, vmss, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("vmssClient.CreateOrUpdate failed for '%s'", vmssName))
+
+	fmt.Println("List scale set instances...")
+	instances, err := vmssVMsClient.List(groupName, vmssName, "", "", "")
+	onErrorFail(err, fmt.Sprintf("vmssVMsClient.List failed for '%s'", vmssName))
+	if instances.Value == nil || len(*instances.Value) == 0 {
+		return
+	}
+
+	instanceID := *(*instances.Value)[0].InstanceID
+	fmt.Printf("Power off scale set instance '%s'...\n", instanceID)
+	_, errChan = vmssVMsClient.PowerOff(groupName, vmssName, instanceID, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("vmssVMsClient.PowerOff failed for instance '%s'", instanceID))
+}
+
 // vmOperations performs simple VM operations.
 func vmOperations(vmName string, wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -270,9 +934,15 @@ func vmOperations(vmName string, wg *sync.WaitGroup) {
 	attachDataDisk(vmName, vm)
 	detachDataDisks(vmName, vm)
 	updateOSdiskSize(vmName, vm)
+	if useManagedDisks {
+		snapshotOSDisk(vmName, vm)
+	}
 	startVM(vmName)
 	restartVM(vmName)
 	stopVM(vmName)
+	if useManagedDisks {
+		captureImage(vmName)
+	}
 }
 
 func getVM(vmName string) *compute.VirtualMachine {
@@ -295,8 +965,16 @@ func updateVM(vmName string, vm *compute.VirtualMachine) {
 
 func attachDataDisk(vmName string, vm *compute.VirtualMachine) {
 	fmt.Printf("Attach data disk to VM '%s' (via CreateOrUpdate operation)\n", vmName)
-	vm.StorageProfile.DataDisks = &[]compute.DataDisk{
-		{
+	vm.StorageProfile.DataDisks = &[]compute.DataDisk{buildDataDisk(vmName)}
+	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("vmClient.CreateOrUpdate failed for '%s'", vmName))
+}
+
+// buildDataDisk builds the data disk to attach to vmName, as an Azure Managed Disk
+// via disksClient when useManagedDisks is set or an unmanaged VHD otherwise.
+func buildDataDisk(vmName string) compute.DataDisk {
+	if !useManagedDisks {
+		return compute.DataDisk{
 			Lun:  to.Int32Ptr(0),
 			Name: to.StringPtr("dataDisk"),
 			Vhd: &compute.VirtualHardDisk{
@@ -304,10 +982,31 @@ func attachDataDisk(vmName string, vm *compute.VirtualMachine) {
 			},
 			CreateOption: compute.DiskCreateOptionTypesEmpty,
 			DiskSizeGB:   to.Int32Ptr(1),
+		}
+	}
+
+	diskName := fmt.Sprintf("%s-datadisk", vmName)
+	diskParameters := compute.Disk{
+		Location: &location,
+		DiskProperties: &compute.DiskProperties{
+			CreationData: &compute.CreationData{CreateOption: compute.DiskCreateOptionTypesEmpty},
+			AccountType:  compute.PremiumLRS,
+			DiskSizeGB:   to.Int32Ptr(1),
 		},
 	}
-	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, nil)
-	onErrorFail(<-errChan, fmt.Sprintf("vmClient.CreateOrUpdate failed for '%s'", vmName))
+	_, errChan := disksClient.CreateOrUpdate(groupName, diskName, diskParameters, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("disksClient.CreateOrUpdate failed for '%s'", diskName))
+
+	disk, err := disksClient.Get(groupName, diskName)
+	onErrorFail(err, fmt.Sprintf("disksClient.Get failed for '%s'", diskName))
+
+	return compute.DataDisk{
+		Lun:          to.Int32Ptr(0),
+		Name:         &diskName,
+		ManagedDisk:  &compute.ManagedDiskParameters{ID: disk.ID},
+		CreateOption: compute.DiskCreateOptionTypesAttach,
+		DiskSizeGB:   disk.DiskSizeGB,
+	}
 }
 
 func detachDataDisks(vmName string, vm *compute.VirtualMachine) {
@@ -319,11 +1018,17 @@ func detachDataDisks(vmName string, vm *compute.VirtualMachine) {
 
 func updateOSdiskSize(vmName string, vm *compute.VirtualMachine) {
 	fmt.Printf("Update OS disk size for VM '%s' (via Deallocate and CreateOrUpdate operations)\n", vmName)
+	_, errChan := vmClient.Deallocate(groupName, vmName, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("Deallocate failed for '%s'", vmName))
+
+	if useManagedDisks {
+		resizeManagedOSDisk(vmName, vm)
+		return
+	}
+
 	if vm.StorageProfile.OsDisk.DiskSizeGB == nil {
 		vm.StorageProfile.OsDisk.DiskSizeGB = to.Int32Ptr(0)
 	}
-	_, errChan := vmClient.Deallocate(groupName, vmName, nil)
-	onErrorFail(<-errChan, fmt.Sprintf("Deallocate failed for '%s'", vmName))
 	if *vm.StorageProfile.OsDisk.DiskSizeGB <= 0 {
 		*vm.StorageProfile.OsDisk.DiskSizeGB = 256
 	}
@@ -332,6 +1037,71 @@ func updateOSdiskSize(vmName string, vm *compute.VirtualMachine) {
 	onErrorFail(<-errChan, fmt.Sprintf("vmClient.CreateOrUpdate failed for '%s'", vmName))
 }
 
+// resizeManagedOSDisk grows the managed OS disk backing vmName by patching the
+// Disk resource directly. The VM must already be deallocated.
+func resizeManagedOSDisk(vmName string, vm *compute.VirtualMachine) {
+	diskName := resourceNameFromID(*vm.StorageProfile.OsDisk.ManagedDisk.ID)
+	disk, err := disksClient.Get(groupName, diskName)
+	onErrorFail(err, fmt.Sprintf("disksClient.Get failed for '%s'", diskName))
+	if disk.DiskSizeGB == nil || *disk.DiskSizeGB <= 0 {
+		disk.DiskSizeGB = to.Int32Ptr(256)
+	}
+	*disk.DiskSizeGB += 10
+	_, errChan := disksClient.CreateOrUpdate(groupName, diskName, disk, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("disksClient.CreateOrUpdate failed for '%s'", diskName))
+}
+
+// snapshotOSDisk creates a point-in-time snapshot of the managed OS disk backing vmName.
+func snapshotOSDisk(vmName string, vm *compute.VirtualMachine) {
+	fmt.Printf("Snapshot OS disk for VM '%s'...\n", vmName)
+	snapshotName := fmt.Sprintf("%s-osdisk-snapshot", vmName)
+	snapshotParameters := compute.Snapshot{
+		Location: &location,
+		SnapshotProperties: &compute.SnapshotProperties{
+			CreationData: &compute.CreationData{
+				CreateOption:     compute.Copy,
+				SourceResourceID: vm.StorageProfile.OsDisk.ManagedDisk.ID,
+			},
+		},
+	}
+	_, errChan := snapshotsClient.CreateOrUpdate(groupName, snapshotName, snapshotParameters, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("snapshotsClient.CreateOrUpdate failed for '%s'", snapshotName))
+	fmt.Printf("\tCreated snapshot '%s'\n", snapshotName)
+}
+
+// captureImage deallocates and generalizes vmName, then captures it into a reusable
+// custom Image via ImagesClient.CreateOrUpdate, printing the resulting image resource
+// ID so it can back an ImageReference.ID for subsequent VMs.
+func captureImage(vmName string) {
+	fmt.Printf("Capture '%s' VM into a reusable image...\n", vmName)
+	_, errChan := vmClient.Deallocate(groupName, vmName, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("vmClient.Deallocate failed for '%s'", vmName))
+
+	_, err := vmClient.Generalize(groupName, vmName)
+	onErrorFail(err, fmt.Sprintf("vmClient.Generalize failed for '%s'", vmName))
+
+	imageName := fmt.Sprintf("%s-image", vmName)
+	vm := getVM(vmName)
+	imageParameters := compute.Image{
+		Location: &location,
+		ImageProperties: &compute.ImageProperties{
+			SourceVirtualMachine: &compute.SubResource{ID: vm.ID},
+		},
+	}
+	_, errChan = imagesClient.CreateOrUpdate(groupName, imageName, imageParameters, nil)
+	onErrorFail(<-errChan, fmt.Sprintf("imagesClient.CreateOrUpdate failed for '%s'", imageName))
+
+	image, err := imagesClient.Get(groupName, imageName, "")
+	onErrorFail(err, fmt.Sprintf("imagesClient.Get failed for '%s'", imageName))
+	fmt.Printf("\tCaptured image '%s'\n", *image.ID)
+}
+
+// resourceNameFromID returns the last path segment of an Azure resource ID.
+func resourceNameFromID(id string) string {
+	parts := strings.Split(id, "/")
+	return parts[len(parts)-1]
+}
+
 func startVM(vmName string) {
 	fmt.Println("Start VM...")
 	_, errChan := vmClient.Start(groupName, vmName, nil)
@@ -412,25 +1182,48 @@ func onErrorFail(err error, message string) {
 	}
 }
 
-func createClients(subscriptionID string, authorizer *autorest.BearerAuthorizer) {
-	groupClient = resources.NewGroupsClient(subscriptionID)
+func createClients(subscriptionID string, env azure.Environment, authorizer autorest.Authorizer) {
+	endpoint := env.ResourceManagerEndpoint
+
+	groupClient = resources.NewGroupsClientWithBaseURI(endpoint, subscriptionID)
 	groupClient.Authorizer = authorizer
 
-	accountClient = storage.NewAccountsClient(subscriptionID)
+	accountClient = storage.NewAccountsClientWithBaseURI(endpoint, subscriptionID)
 	accountClient.Authorizer = authorizer
 
-	vNetClient = network.NewVirtualNetworksClient(subscriptionID)
+	vNetClient = network.NewVirtualNetworksClientWithBaseURI(endpoint, subscriptionID)
 	vNetClient.Authorizer = authorizer
 
-	subnetClient = network.NewSubnetsClient(subscriptionID)
+	subnetClient = network.NewSubnetsClientWithBaseURI(endpoint, subscriptionID)
 	subnetClient.Authorizer = authorizer
 
-	addressClient = network.NewPublicIPAddressesClient(subscriptionID)
+	addressClient = network.NewPublicIPAddressesClientWithBaseURI(endpoint, subscriptionID)
 	addressClient.Authorizer = authorizer
 
-	interfacesClient = network.NewInterfacesClient(subscriptionID)
+	interfacesClient = network.NewInterfacesClientWithBaseURI(endpoint, subscriptionID)
 	interfacesClient.Authorizer = authorizer
 
-	vmClient = compute.NewVirtualMachinesClient(subscriptionID)
+	nsgClient = network.NewSecurityGroupsClientWithBaseURI(endpoint, subscriptionID)
+	nsgClient.Authorizer = authorizer
+
+	vmClient = compute.NewVirtualMachinesClientWithBaseURI(endpoint, subscriptionID)
 	vmClient.Authorizer = authorizer
+
+	disksClient = compute.NewDisksClientWithBaseURI(endpoint, subscriptionID)
+	disksClient.Authorizer = authorizer
+
+	snapshotsClient = compute.NewSnapshotsClientWithBaseURI(endpoint, subscriptionID)
+	snapshotsClient.Authorizer = authorizer
+
+	imagesClient = compute.NewImagesClientWithBaseURI(endpoint, subscriptionID)
+	imagesClient.Authorizer = authorizer
+
+	lbClient = network.NewLoadBalancersClientWithBaseURI(endpoint, subscriptionID)
+	lbClient.Authorizer = authorizer
+
+	vmssClient = compute.NewVirtualMachineScaleSetsClientWithBaseURI(endpoint, subscriptionID)
+	vmssClient.Authorizer = authorizer
+
+	vmssVMsClient = compute.NewVirtualMachineScaleSetVMsClientWithBaseURI(endpoint, subscriptionID)
+	vmssVMsClient.Authorizer = authorizer
 }
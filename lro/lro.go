@@ -0,0 +1,69 @@
+// Package lro helps callers run Azure long-running operations with a
+// context.Context instead of the bare cancellation channels this generation
+// of the Azure SDK for Go expects, and reports their progress and outcome
+// in a uniform way.
+package lro
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Progress describes a single long-running operation as it completes, for
+// callers that want to log or display it.
+type Progress struct {
+	Resource  string
+	Operation string
+	Elapsed   time.Duration
+}
+
+// Error is returned when a long-running operation finishes in a terminal
+// Canceled or Failed state, recording which state it ended in.
+type Error struct {
+	Resource  string
+	Operation string
+	State     string
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %s: %v", e.Operation, e.Resource, e.State, e.Err)
+}
+
+// Run calls fn, which should perform a single SDK call such as
+// client.CreateOrUpdate(..., cancel), passing it a cancellation channel that
+// closes when ctx is done. It blocks until fn returns (the SDK call itself
+// polls the operation's async URL until a terminal state is reached), then,
+// if progress is non-nil, sends a Progress event recording how long the
+// operation took. A non-nil error from fn is wrapped in *Error, using
+// "Canceled" as the state when ctx was the cause and "Failed" otherwise.
+func Run(ctx context.Context, resource, operation string, progress chan<- Progress, fn func(cancel <-chan struct{}) error) error {
+	start := time.Now()
+	cancel := make(chan struct{})
+	done := make(chan error, 1)
+
+	go func() { done <- fn(cancel) }()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		close(cancel)
+		<-done
+		err = ctx.Err()
+	case err = <-done:
+	}
+
+	if progress != nil {
+		progress <- Progress{Resource: resource, Operation: operation, Elapsed: time.Since(start)}
+	}
+
+	if err == nil {
+		return nil
+	}
+	state := "Failed"
+	if err == ctx.Err() && err != nil {
+		state = "Canceled"
+	}
+	return &Error{Resource: resource, Operation: operation, State: state, Err: err}
+}
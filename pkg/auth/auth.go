@@ -0,0 +1,178 @@
+// Package auth resolves an Azure cloud environment and builds an authorizer
+// for it, trying a chain of authentication modes instead of requiring the
+// caller to pick one up front.
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// msiEndpoint is the well-known endpoint the Azure Instance Metadata Service
+// exposes for acquiring a managed identity token.
+const msiEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// GetEnvironment resolves the Azure cloud environment to target, defaulting to
+// AzurePublicCloud. Set AZURE_ENVIRONMENT to AzureChinaCloud, AzureGermanCloud,
+// AzureUSGovernmentCloud, or the path to a custom environment JSON file.
+func GetEnvironment() (azure.Environment, error) {
+	name := os.Getenv("AZURE_ENVIRONMENT")
+	if name == "" {
+		return azure.PublicCloud, nil
+	}
+	if _, err := os.Stat(name); err == nil {
+		return azure.EnvironmentFromFile(name)
+	}
+	return azure.EnvironmentFromName(name)
+}
+
+// NewAuthorizer returns the first authorizer that can be built for env,
+// trying, in order: a service principal from environment variables, the
+// VM's managed service identity, a token cached by the Azure CLI, and
+// finally an interactive device-code login. It fails if every mode fails,
+// reporting why each one did.
+func NewAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	modes := []struct {
+		name string
+		new  func(azure.Environment) (autorest.Authorizer, error)
+	}{
+		{"service principal", servicePrincipalAuthorizer},
+		{"managed service identity", msiAuthorizer},
+		{"az CLI", cliAuthorizer},
+		{"device code", deviceFlowAuthorizer},
+	}
+
+	var errs []string
+	for _, mode := range modes {
+		authorizer, err := mode.new(env)
+		if err == nil {
+			return authorizer, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", mode.name, err))
+	}
+	return nil, fmt.Errorf("no authentication mode succeeded:\n%s", strings.Join(errs, "\n"))
+}
+
+// servicePrincipalAuthorizer authenticates with the service principal described by
+// the AZURE_CLIENT_ID, AZURE_CLIENT_SECRET and AZURE_TENANT_ID environment variables.
+func servicePrincipalAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	credentials := map[string]string{
+		"AZURE_CLIENT_ID":     os.Getenv("AZURE_CLIENT_ID"),
+		"AZURE_CLIENT_SECRET": os.Getenv("AZURE_CLIENT_SECRET"),
+		"AZURE_TENANT_ID":     os.Getenv("AZURE_TENANT_ID")}
+	if err := checkEnvVar(&credentials); err != nil {
+		return nil, err
+	}
+
+	oauthConfig, err := env.OAuthConfigForTenant(credentials["AZURE_TENANT_ID"])
+	if err != nil {
+		return nil, err
+	}
+	spt, err := azure.NewServicePrincipalToken(*oauthConfig, credentials["AZURE_CLIENT_ID"], credentials["AZURE_CLIENT_SECRET"], env.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	return autorest.NewBearerAuthorizer(spt), nil
+}
+
+// msiAuthorizer authenticates as the VM's system-assigned managed identity.
+// NewServicePrincipalTokenFromMSI only validates its arguments, so the token
+// is refreshed here to confirm the MSI endpoint actually answers before this
+// mode is accepted over the CLI or device-code fallbacks.
+func msiAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	spt, err := azure.NewServicePrincipalTokenFromMSI(msiEndpoint, env.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := spt.EnsureFresh(); err != nil {
+		return nil, fmt.Errorf("no managed identity available: %s", err)
+	}
+	return autorest.NewBearerAuthorizer(spt), nil
+}
+
+// deviceFlowAuthorizer walks the user through an interactive device-code login,
+// using the AZURE_CLIENT_ID and AZURE_TENANT_ID environment variables.
+func deviceFlowAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	credentials := map[string]string{
+		"AZURE_CLIENT_ID": os.Getenv("AZURE_CLIENT_ID"),
+		"AZURE_TENANT_ID": os.Getenv("AZURE_TENANT_ID")}
+	if err := checkEnvVar(&credentials); err != nil {
+		return nil, err
+	}
+
+	deviceConfig := azure.NewDeviceFlowConfig(credentials["AZURE_CLIENT_ID"], credentials["AZURE_TENANT_ID"])
+	deviceConfig.AADEndpoint = env.ActiveDirectoryEndpoint
+	deviceConfig.Resource = env.ResourceManagerEndpoint
+	return deviceConfig.Authorize()
+}
+
+// cliAuthorizer authenticates using a token cached by the Azure CLI ('az login'),
+// read from the current user's ~/.azure profile.
+func cliAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	accessToken, err := cliAccessToken(env)
+	if err != nil {
+		return nil, err
+	}
+	return autorest.NewBearerAuthorizer(staticTokenProvider{accessToken}), nil
+}
+
+// cliAccessToken reads the access token cached for env's resource manager endpoint
+// from the Azure CLI's ~/.azure/accessTokens.json.
+func cliAccessToken(env azure.Environment) (string, error) {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = os.Getenv("USERPROFILE")
+	}
+	path := filepath.Join(homeDir, ".azure", "accessTokens.json")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read az CLI token cache %q: %s", path, err)
+	}
+
+	var cachedTokens []struct {
+		AccessToken string `json:"accessToken"`
+		Resource    string `json:"resource"`
+	}
+	if err := json.Unmarshal(data, &cachedTokens); err != nil {
+		return "", fmt.Errorf("failed to parse az CLI token cache %q: %s", path, err)
+	}
+
+	resource := strings.TrimSuffix(env.ResourceManagerEndpoint, "/")
+	for _, cached := range cachedTokens {
+		if strings.TrimSuffix(cached.Resource, "/") == resource {
+			return cached.AccessToken, nil
+		}
+	}
+	return "", fmt.Errorf("no cached az CLI token for %q found, run 'az login' first", resource)
+}
+
+// staticTokenProvider adapts a fixed bearer token to autorest.TokenProvider.
+type staticTokenProvider struct {
+	token string
+}
+
+func (s staticTokenProvider) OAuthToken() string {
+	return s.token
+}
+
+// checkEnvVar checks that every named environment variable is set.
+func checkEnvVar(envVars *map[string]string) error {
+	var missingVars []string
+	for varName, value := range *envVars {
+		if value == "" {
+			missingVars = append(missingVars, varName)
+		}
+	}
+	if len(missingVars) > 0 {
+		return fmt.Errorf("missing environment variables %s", missingVars)
+	}
+	return nil
+}